@@ -0,0 +1,90 @@
+package api
+
+import (
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// Attachment is a message part meant to be opened rather than read inline.
+type Attachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+// parseAttachments walks a raw RFC 822 message, including nested multiparts,
+// and returns its attachments with the transfer encoding removed.
+func parseAttachments(r io.Reader) ([]Attachment, error) {
+	m, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var attachments []Attachment
+	err = walkParts(textproto.MIMEHeader(m.Header), m.Body, &attachments)
+	return attachments, err
+}
+
+func walkParts(header textproto.MIMEHeader, body io.Reader, attachments *[]Attachment) error {
+	contentType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		contentType = "text/plain"
+	}
+
+	if strings.HasPrefix(contentType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			p, err := mr.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := walkParts(p.Header, p, attachments); err != nil {
+				return err
+			}
+		}
+	}
+
+	disposition, dispParams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	filename := dispParams["filename"]
+	if filename == "" {
+		filename = params["name"]
+	}
+	if decoded, err := new(mime.WordDecoder).DecodeHeader(filename); err == nil {
+		filename = decoded
+	}
+
+	inline := strings.HasPrefix(contentType, "text/plain") || strings.HasPrefix(contentType, "text/html")
+	if disposition != "attachment" && filename == "" && inline {
+		return nil
+	}
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	decoded, err := decodeBody(string(data), header.Get("Content-Transfer-Encoding"))
+	if err != nil {
+		return err
+	}
+
+	if filename == "" {
+		filename = "unnamed"
+		if exts, _ := mime.ExtensionsByType(contentType); len(exts) > 0 {
+			filename += exts[0]
+		}
+	}
+
+	*attachments = append(*attachments, Attachment{
+		Filename:    filename,
+		ContentType: contentType,
+		Data:        []byte(decoded),
+	})
+	return nil
+}
@@ -2,8 +2,13 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"os"
+	"slices"
+	"sync"
+	"time"
 )
 
 type EmailClient struct {
@@ -14,18 +19,45 @@ type EmailClient struct {
 }
 
 type Message struct {
-	Subject  string
-	Body     string
-	From     string
-	ThreadId string
-	To       string
+	Subject  string `json:"subject"`
+	Body     string `json:"body"`
+	From     string `json:"from"`
+	ThreadId string `json:"thread_id,omitempty"`
+	To       string `json:"to"`
+	Cc       string `json:"cc,omitempty"`
+	Bcc      string `json:"bcc,omitempty"`
+}
+
+// MessageSummary is what the message list shows for one message, or for one
+// thread on Gmail.
+type MessageSummary struct {
+	Id            string
+	ThreadId      string
+	From          string
+	Subject       string
+	Date          time.Time
+	Unread        bool
+	Flagged       bool
+	HasAttachment bool
+	Labels        []string // Gmail label ids
+}
+
+// Folder is somewhere messages can be moved to: an IMAP mailbox, a Gmail
+// label or a Graph mail folder.
+type Folder struct {
+	Id   string
+	Name string
 }
 
 type Config struct {
 	Gmail           GmailConfig
 	Graph           GraphConfig
 	IMAP            IMAPConfig
-	SelectedService string `json:"selected_service"`
+	Viewer          ViewerConfig  `json:"viewer"`
+	UI              UIConfig      `json:"ui"`
+	Secrets         SecretsConfig `json:"secrets"`
+	OAuth           OAuthConfig   `json:"oauth"`
+	SelectedService string        `json:"selected_service"`
 }
 
 type GmailConfig struct {
@@ -49,9 +81,137 @@ type GraphConfig struct {
 type IMAPConfig struct {
 	Server   string `json:"server"`
 	Username string `json:"username"`
-	Password string `json:"password"`
+	// Password is only kept here if secrets are stored in plain text;
+	// otherwise it is moved to the secret store.
+	Password string `json:"password,omitempty"`
+	// PasswordCmd is a command that prints the password, such as
+	// "pass show mail/work". It takes precedence over Password.
+	PasswordCmd string `json:"password_cmd,omitempty"`
+
+	// Auth is how to log in: "login" with the password, the default, or
+	// "xoauth2" or "oauthbearer" with an OAuth token.
+	Auth  string          `json:"auth,omitempty"`
+	OAuth IMAPOAuthConfig `json:"oauth"`
+
+	// Security is "tls", the default, "starttls", or "plaintext" for test
+	// servers on a trusted network. Without a port in Server, 993 is used
+	// for TLS and 143 otherwise.
+	Security string `json:"security,omitempty"`
+	// CAFile is a PEM bundle of CAs to trust besides the system's.
+	CAFile string `json:"ca_file,omitempty"`
+	// PinnedCert is the SHA-256 fingerprint of the server's certificate,
+	// such as "sha256:AB:CD:...". It is trusted whoever signed it.
+	PinnedCert string `json:"pinned_cert,omitempty"`
+	// Timeout is how many seconds connecting or a request may take before
+	// the connection is given up on.
+	// 0 means 30.
+	Timeout int `json:"timeout,omitempty"`
+}
+
+// IMAPOAuthConfig says where the OAuth tokens of an IMAP account come from.
+// Provider "gmail" uses client_secret.json, like the Gmail API does;
+// "microsoft" signs in to Microsoft 365, by default with the Graph app's
+// client id and tenant. Without a provider the client id, endpoints and
+// scopes must all be given.
+type IMAPOAuthConfig struct {
+	Provider     string   `json:"provider,omitempty"`
+	ClientId     string   `json:"client_id,omitempty"`
+	ClientSecret string   `json:"client_secret,omitempty"`
+	Tenant       string   `json:"tenant,omitempty"`
+	AuthURL      string   `json:"auth_url,omitempty"`
+	TokenURL     string   `json:"token_url,omitempty"`
+	Scopes       []string `json:"scopes,omitempty"`
+}
+
+// ViewerConfig names the external programs used to display message parts.
+type ViewerConfig struct {
+	HTMLCommand    string `json:"html_command"`    // e.g. "w3m -dump -T text/html"
+	Mailcap        string `json:"mailcap"`         // defaults to $MAILCAPS, ~/.mailcap, /etc/mailcap
+	BrowserCommand string `json:"browser_command"` // defaults to $BROWSER, then xdg-open
+	CopyCommand    string `json:"copy_command"`    // e.g. "wl-copy"; defaults to an OSC 52 escape
+	Hyperlinks     bool   `json:"hyperlinks"`      // emit OSC 8 hyperlinks in the message pane
+}
+
+// UIConfig holds interface preferences.
+type UIConfig struct {
+	Columns []ColumnConfig `json:"columns"`
+
+	// MarkRead is when opened messages become read: "open" (the default),
+	// "delay" after MarkReadDelay seconds, or "never".
+	MarkRead      string `json:"mark_read"`
+	MarkReadDelay int    `json:"mark_read_delay"`
+
+	// SendDelay is how many seconds a sent message is held back, during
+	// which it can be recalled into the compose page. 0 sends at once.
+	SendDelay int `json:"send_delay"`
+
+	// UndoGrace is how many seconds a delete, archive, move, label or flag
+	// change waits before it is sent to the server, during which undoing it
+	// is purely local. 0 means the default; a negative value sends changes
+	// at once.
+	UndoGrace int `json:"undo_grace"`
+
+	// RefreshInterval is how many seconds auto-refresh waits between syncs
+	// of the message list. 0 means the default.
+	RefreshInterval int `json:"refresh_interval"`
+	// AutoRefresh turns the periodic sync on or off; unset leaves it on.
+	AutoRefresh *bool `json:"auto_refresh,omitempty"`
+
+	// ListWidth is the share of the window, in percent, the message list
+	// takes. 0 means the default.
+	ListWidth int `json:"list_width"`
+
+	// Theme names a built-in theme or one under MAILTERM_HOME/themes.
+	Theme string `json:"theme"`
+}
+
+// ColumnConfig is one message list column. Name is one of "flags", "date",
+// "from" or "subject"; a Width of 0 lets the column fill the remaining space.
+type ColumnConfig struct {
+	Name  string `json:"name"`
+	Width int    `json:"width"`
+}
+
+// columnNames are the columns the message list can show.
+var columnNames = []string{"flags", "date", "from", "subject"}
+
+// Sanitize resets the settings that are out of range to their defaults and
+// returns an error describing each one it reset, or nil if all were valid.
+func (c *UIConfig) Sanitize() error {
+	var errs []error
+	for _, column := range c.Columns {
+		if !slices.Contains(columnNames, column.Name) || column.Width < 0 {
+			errs = append(errs, fmt.Errorf("columns: invalid column %q of width %d; using the default columns", column.Name, column.Width))
+			c.Columns = nil
+			break
+		}
+	}
+	if !slices.Contains([]string{"", "open", "delay", "never"}, c.MarkRead) {
+		errs = append(errs, fmt.Errorf("mark_read: %q is not open, delay or never", c.MarkRead))
+		c.MarkRead = ""
+	}
+	nonNegative := func(name string, value *int) {
+		if *value < 0 {
+			errs = append(errs, fmt.Errorf("%s: %d is negative", name, *value))
+			*value = 0
+		}
+	}
+	nonNegative("mark_read_delay", &c.MarkReadDelay)
+	nonNegative("send_delay", &c.SendDelay)
+	nonNegative("refresh_interval", &c.RefreshInterval)
+	if c.ListWidth != 0 && (c.ListWidth < MinListWidth || c.ListWidth > MaxListWidth) {
+		errs = append(errs, fmt.Errorf("list_width: %d is not between %d and %d", c.ListWidth, MinListWidth, MaxListWidth))
+		c.ListWidth = 0
+	}
+	return errors.Join(errs...)
 }
 
+// The bounds of UIConfig.ListWidth.
+const (
+	MinListWidth = 10
+	MaxListWidth = 90
+)
+
 var baseDir string
 
 func NewEmailClient(selectedService string) (*EmailClient, error) {
@@ -85,7 +245,6 @@ func NewEmailClient(selectedService string) (*EmailClient, error) {
 }
 
 func (c *EmailClient) SwitchToGmail() {
-	GmailPage = ""
 	c.ActiveService = "gmail"
 }
 
@@ -97,6 +256,33 @@ func (c *EmailClient) SwitchToIMAP() {
 	c.ActiveService = "imap"
 }
 
+// Send sends a message through the given service, which need not be the
+// active one.
+func (c *EmailClient) Send(service string, email Message) error {
+	switch service {
+	case "gmail":
+		if c.GmailClient == nil {
+			return fmt.Errorf("Gmail is not set up")
+		}
+		return c.GmailClient.SendMessage(c.GmailClient.PrepareMessageForSending(email))
+	case "graph":
+		if c.GraphClient == nil {
+			return fmt.Errorf("Microsoft Graph is not set up")
+		}
+		return c.GraphClient.SendMessage(PrepareGraphMessage(email))
+	case "imap":
+		return fmt.Errorf("sending is not supported for IMAP accounts")
+	}
+	return fmt.Errorf("unknown service %q", service)
+}
+
+// migrated records that LoadConfig has moved the secrets to the store. A
+// failed move is tried again the next time the config is loaded.
+var (
+	migrateMu sync.Mutex
+	migrated  bool
+)
+
 func LoadConfig() (*Config, error) {
 	baseDir = os.Getenv("MAILTERM_HOME")
 	file, err := os.ReadFile(fmt.Sprintf("%s/config.json", baseDir))
@@ -109,15 +295,41 @@ func LoadConfig() (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
+	htmlCommand = config.Viewer.HTMLCommand
+	secretsConfig = config.Secrets
+	oauthSettings = config.OAuth
+
+	// secrets left in plain text by earlier versions move to the store
+	migrateMu.Lock()
+	defer migrateMu.Unlock()
+	if !migrated {
+		changed, err := migrateSecrets(&config)
+		if err != nil {
+			log.Printf("Unable to move secrets to the secret store: %v", err)
+		}
+		migrated = err == nil
+		if changed {
+			if err := SaveConfig(&config); err != nil {
+				log.Printf("Unable to save config: %v", err)
+				migrated = false
+			}
+		}
+	}
 
 	return &config, nil
 }
 
+// SaveConfig writes the config, readable only by the user. Secrets in it are
+// moved to the secret store first, unless they are kept in plain text.
 func SaveConfig(config *Config) error {
 	baseDir = os.Getenv("MAILTERM_HOME")
+	secretsConfig = config.Secrets
+	if _, err := migrateSecrets(config); err != nil {
+		return err
+	}
 	file, err := json.MarshalIndent(config, "", "  ")
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(fmt.Sprintf("%s/config.json", baseDir), file, 0644)
+	return writeFileAtomic(fmt.Sprintf("%s/config.json", baseDir), file, 0600)
 }
@@ -5,10 +5,9 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
-	"errors"
 	"fmt"
+	"html"
 	"io"
-	"log"
 	"mime"
 	"mime/multipart"
 	"mime/quotedprintable"
@@ -16,10 +15,12 @@ import (
 	"net/mail"
 	"os"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/PuerkitoBio/goquery"
+	"github.com/rivo/tview"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/gmail/v1"
@@ -29,9 +30,26 @@ import (
 // GmailClient for later access
 type GmailClient struct {
 	Service *gmail.Service
+
+	mu       sync.Mutex
+	metadata map[string]threadMetadata
+}
+
+// threadMetadata caches what the message list needs from a thread. It stays
+// valid while the thread's history id is unchanged.
+type threadMetadata struct {
+	historyId  uint64
+	summary    MessageSummary
+	messageIds []string
 }
 
-var GmailPage string
+const (
+	metadataWorkers  = 10
+	batchModifyLimit = 1000 // ids per batchModify request
+	// metadataCacheSize bounds the metadata cache. It is emptied when full,
+	// which costs one refetch of the threads still in view.
+	metadataCacheSize = 5000
+)
 
 func NewGmailClient() (*GmailClient, error) {
 	ctx := context.Background()
@@ -42,13 +60,16 @@ func NewGmailClient() (*GmailClient, error) {
 
 	config, err := google.ConfigFromJSON(b, gmail.GmailModifyScope)
 	if err != nil {
-		log.Fatalf("Unable to parse client secret file to config: %v", err)
+		return nil, fmt.Errorf("parsing client secret file: %w", err)
+	}
+	client, err := getHttpClient(config)
+	if err != nil {
+		return nil, err
 	}
-	client := getHttpClient(config)
 
 	srv, err := gmail.NewService(ctx, option.WithHTTPClient(client))
 	if err != nil {
-		log.Fatalf("Unable to retrieve Gmail client: %v", err)
+		return nil, fmt.Errorf("creating Gmail service: %w", err)
 	}
 
 	return &GmailClient{Service: srv}, nil
@@ -60,6 +81,12 @@ func (gc *GmailClient) PrepareMessageForSending(email Message) *gmail.Message {
 	// Write headers
 	_, _ = fmt.Fprintf(&message, "From: %s\r\n", email.From)
 	_, _ = fmt.Fprintf(&message, "To: %s\r\n", email.To)
+	if email.Cc != "" {
+		_, _ = fmt.Fprintf(&message, "Cc: %s\r\n", email.Cc)
+	}
+	if email.Bcc != "" {
+		_, _ = fmt.Fprintf(&message, "Bcc: %s\r\n", email.Bcc)
+	}
 	_, _ = fmt.Fprintf(&message, "Subject: %s\r\n", email.Subject)
 	_, _ = fmt.Fprintf(&message, "MIME-Version: 1.0\r\n")
 	_, _ = fmt.Fprintf(&message, "Content-Type: text/plain; charset=\"utf-8\"\r\n")
@@ -93,27 +120,369 @@ func (gc *GmailClient) TrashMessage(messageId string) error {
 	return nil
 }
 
-func (gc *GmailClient) GetThreads() ([]*gmail.Thread, error) {
-	if GmailPage != "" {
-		r, err := gc.Service.Users.Threads.List("me").
-			PageToken(GmailPage).
-			MaxResults(20).
-			Do()
+// TrashThreads moves threads to the trash by labelling their messages
+// TRASH, which unlike trashing each thread takes one batchModify call.
+func (gc *GmailClient) TrashThreads(threadIds ...string) error {
+	return gc.ModifyThreadLabels(threadIds, []string{"TRASH"}, nil)
+}
+
+// UntrashThreads takes threads back out of the trash.
+func (gc *GmailClient) UntrashThreads(threadIds ...string) error {
+	return gc.ModifyThreadLabels(threadIds, nil, []string{"TRASH"})
+}
+
+// ModifyThreadLabels adds and removes labels on every message of the given
+// threads, with batchModify on up to batchModifyLimit message ids at a time.
+func (gc *GmailClient) ModifyThreadLabels(threadIds []string, add, remove []string) error {
+	messageIds, err := gc.threadMessageIds(threadIds)
+	if err != nil {
+		return err
+	}
+	for len(messageIds) > 0 {
+		n := min(len(messageIds), batchModifyLimit)
+		err := gc.Service.Users.Messages.BatchModify("me", &gmail.BatchModifyMessagesRequest{
+			Ids:            messageIds[:n],
+			AddLabelIds:    add,
+			RemoveLabelIds: remove,
+		}).Do()
 		if err != nil {
-			return nil, err
+			return fmt.Errorf("unable to modify messages: %v", err)
 		}
-		GmailPage = r.NextPageToken
-		return r.Threads, nil
-	} else {
-		r, err := gc.Service.Users.Threads.List("me").
-			MaxResults(20).
-			Do()
+		messageIds = messageIds[n:]
+	}
+	return nil
+}
+
+// threadMessageIds lists the messages of threads. The ids in the metadata
+// cache are used for threads that have had no message added or deleted since
+// they were cached, which one history request tells; the other threads are
+// fetched.
+func (gc *GmailClient) threadMessageIds(threadIds []string) ([]string, error) {
+	cached := make(map[string][]string)
+	var since uint64
+	gc.mu.Lock()
+	for _, threadId := range threadIds {
+		if meta, ok := gc.metadata[threadId]; ok {
+			cached[threadId] = meta.messageIds
+			if since == 0 || meta.historyId < since {
+				since = meta.historyId
+			}
+		}
+	}
+	gc.mu.Unlock()
+
+	if len(cached) > 0 {
+		err := gc.Service.Users.History.List("me").
+			StartHistoryId(since).
+			HistoryTypes("messageAdded", "messageDeleted").
+			Fields("history(messagesAdded(message(threadId)),messagesDeleted(message(threadId))),nextPageToken").
+			Pages(context.Background(), func(r *gmail.ListHistoryResponse) error {
+				for _, h := range r.History {
+					for _, added := range h.MessagesAdded {
+						if added.Message != nil {
+							delete(cached, added.Message.ThreadId)
+						}
+					}
+					for _, deleted := range h.MessagesDeleted {
+						if deleted.Message != nil {
+							delete(cached, deleted.Message.ThreadId)
+						}
+					}
+				}
+				return nil
+			})
 		if err != nil {
-			return nil, err
+			// the history may no longer reach back that far
+			clear(cached)
+		}
+	}
+
+	ids := make([][]string, len(threadIds))
+	errs := make([]error, len(threadIds))
+	sem := make(chan struct{}, metadataWorkers)
+	var wg sync.WaitGroup
+	for i, threadId := range threadIds {
+		if messageIds, ok := cached[threadId]; ok {
+			ids[i] = messageIds
+			continue
+		}
+		wg.Add(1)
+		go func(i int, threadId string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			t, err := gc.Service.Users.Threads.Get("me", threadId).
+				Format("minimal").
+				Fields("messages(id)").
+				Do()
+			if err != nil {
+				errs[i] = fmt.Errorf("unable to get thread: %v", err)
+				return
+			}
+			for _, m := range t.Messages {
+				ids[i] = append(ids[i], m.Id)
+			}
+		}(i, threadId)
+	}
+	wg.Wait()
+
+	var messageIds []string
+	for i := range threadIds {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		messageIds = append(messageIds, ids[i]...)
+	}
+	return messageIds, nil
+}
+
+// MarkThreadsRead sets or clears the UNREAD label of threads.
+func (gc *GmailClient) MarkThreadsRead(read bool, threadIds ...string) error {
+	if read {
+		return gc.ModifyThreadLabels(threadIds, nil, []string{"UNREAD"})
+	}
+	return gc.ModifyThreadLabels(threadIds, []string{"UNREAD"}, nil)
+}
+
+// StarThreads sets or clears the STARRED label of threads.
+func (gc *GmailClient) StarThreads(starred bool, threadIds ...string) error {
+	if starred {
+		return gc.ModifyThreadLabels(threadIds, []string{"STARRED"}, nil)
+	}
+	return gc.ModifyThreadLabels(threadIds, nil, []string{"STARRED"})
+}
+
+// ArchiveThreads takes threads out of the inbox.
+func (gc *GmailClient) ArchiveThreads(threadIds ...string) error {
+	return gc.ModifyThreadLabels(threadIds, nil, []string{"INBOX"})
+}
+
+// MoveThreads files threads under a label and takes them out of the inbox,
+// which is the closest Gmail has to moving them to a folder. Moving them to
+// the inbox only adds INBOX, since Gmail rejects adding and removing the
+// same label.
+func (gc *GmailClient) MoveThreads(labelId string, threadIds ...string) error {
+	return gc.ModifyThreadLabels(threadIds, []string{labelId}, GmailMoveRemoves(labelId))
+}
+
+// GmailMoveRemoves returns the labels MoveThreads takes off threads it
+// moves under labelId.
+func GmailMoveRemoves(labelId string) []string {
+	if labelId == "INBOX" {
+		return nil
+	}
+	return []string{"INBOX"}
+}
+
+// GetLabels lists the account's labels, system labels first, each group
+// sorted by name.
+func (gc *GmailClient) GetLabels() ([]*gmail.Label, error) {
+	r, err := gc.Service.Users.Labels.List("me").Do()
+	if err != nil {
+		return nil, err
+	}
+
+	labels := r.Labels
+	sort.SliceStable(labels, func(i, j int) bool {
+		if labels[i].Type != labels[j].Type {
+			return labels[i].Type == "system"
+		}
+		return strings.ToLower(labels[i].Name) < strings.ToLower(labels[j].Name)
+	})
+	return labels, nil
+}
+
+func (gc *GmailClient) CreateLabel(name string) (*gmail.Label, error) {
+	label, err := gc.Service.Users.Labels.Create("me", &gmail.Label{
+		Name:                  name,
+		LabelListVisibility:   "labelShow",
+		MessageListVisibility: "show",
+	}).Do()
+	if err != nil {
+		return nil, fmt.Errorf("unable to create label: %v", err)
+	}
+	return label, nil
+}
+
+func (gc *GmailClient) RenameLabel(labelId, name string) error {
+	_, err := gc.Service.Users.Labels.Patch("me", labelId, &gmail.Label{Name: name}).Do()
+	if err != nil {
+		return fmt.Errorf("unable to rename label: %v", err)
+	}
+	return nil
+}
+
+func (gc *GmailClient) DeleteLabel(labelId string) error {
+	err := gc.Service.Users.Labels.Delete("me", labelId).Do()
+	if err != nil {
+		return fmt.Errorf("unable to delete label: %v", err)
+	}
+	return nil
+}
+
+// GetFolders lists the labels a thread can be moved to.
+func (gc *GmailClient) GetFolders() ([]Folder, error) {
+	labels, err := gc.GetLabels()
+	if err != nil {
+		return nil, err
+	}
+
+	var folders []Folder
+	for _, label := range labels {
+		if label.Type == "user" || label.Id == "INBOX" || label.Id == "SPAM" || label.Id == "TRASH" {
+			folders = append(folders, Folder{Id: label.Id, Name: label.Name})
+		}
+	}
+	return folders, nil
+}
+
+// ThreadFilter narrows a thread listing. The zero value lists every thread.
+type ThreadFilter struct {
+	LabelId string
+	Query   string // a search such as "from:bob subject:report"
+}
+
+// GetThreads returns one page of threads and the token for the next page,
+// which is empty on the last page.
+func (gc *GmailClient) GetThreads(ctx context.Context, pageToken string, limit int64, filter ThreadFilter) ([]*gmail.Thread, string, error) {
+	call := gc.Service.Users.Threads.List("me").
+		MaxResults(limit)
+	if pageToken != "" {
+		call = call.PageToken(pageToken)
+	}
+	if filter.LabelId != "" {
+		call = call.LabelIds(filter.LabelId)
+	}
+	if filter.Query != "" {
+		call = call.Q(filter.Query)
+	}
+
+	r, err := call.Context(ctx).Do()
+	if err != nil {
+		return nil, "", err
+	}
+	return r.Threads, r.NextPageToken, nil
+}
+
+// SummarizeThread describes a thread for the message list. Threads listings
+// carry no headers, so the snippet stands in for the subject.
+func SummarizeThread(t *gmail.Thread) MessageSummary {
+	return MessageSummary{
+		Id:       t.Id,
+		ThreadId: t.Id,
+		Subject:  html.UnescapeString(t.Snippet),
+	}
+}
+
+// GetThreadSummaries fetches From, Subject and Date for a page of threads
+// with a bounded number of concurrent requests, reusing cached metadata for
+// threads that have not changed. Threads whose metadata cannot be fetched
+// fall back to their snippet.
+func (gc *GmailClient) GetThreadSummaries(ctx context.Context, threads []*gmail.Thread) []MessageSummary {
+	summaries := make([]MessageSummary, len(threads))
+	sem := make(chan struct{}, metadataWorkers)
+	var wg sync.WaitGroup
+
+	for i, t := range threads {
+		gc.mu.Lock()
+		cached, ok := gc.metadata[t.Id]
+		gc.mu.Unlock()
+		if ok && cached.historyId == t.HistoryId {
+			summaries[i] = cached.summary
+			continue
 		}
-		GmailPage = r.NextPageToken
-		return r.Threads, nil
+
+		wg.Add(1)
+		go func(i int, t *gmail.Thread) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			summaries[i] = SummarizeThread(t)
+			full, err := gc.Service.Users.Threads.Get("me", t.Id).
+				Format("metadata").
+				MetadataHeaders("From", "Subject", "Date").
+				Fields("id,historyId,messages(id,labelIds,internalDate,payload(mimeType,headers))").
+				Context(ctx).
+				Do()
+			if err != nil || len(full.Messages) == 0 {
+				return
+			}
+
+			meta := summarizeThreadMetadata(full)
+			summaries[i] = meta.summary
+
+			gc.mu.Lock()
+			if gc.metadata == nil || len(gc.metadata) >= metadataCacheSize {
+				gc.metadata = make(map[string]threadMetadata)
+			}
+			gc.metadata[t.Id] = meta
+			gc.mu.Unlock()
+		}(i, t)
 	}
+
+	wg.Wait()
+	return summaries
+}
+
+// summarizeThreadMetadata takes the subject from the first message and the
+// sender and date from the latest one. The thread is unread, starred or has
+// attachments if any of its messages does. Its id is the thread's, as in
+// SummarizeThread, so that the row keeps its place as messages arrive.
+func summarizeThreadMetadata(t *gmail.Thread) threadMetadata {
+	first, last := t.Messages[0], t.Messages[len(t.Messages)-1]
+	meta := threadMetadata{
+		historyId: t.HistoryId,
+		summary: MessageSummary{
+			Id:       t.Id,
+			ThreadId: t.Id,
+			Subject:  gmailHeader(first, "Subject"),
+			Date:     time.UnixMilli(last.InternalDate),
+		},
+	}
+
+	from := gmailHeader(last, "From")
+	if address, err := mail.ParseAddress(from); err == nil {
+		from = address.Name
+		if from == "" {
+			from = address.Address
+		}
+	}
+	meta.summary.From = from
+
+	labels := make(map[string]bool)
+	for _, m := range t.Messages {
+		meta.messageIds = append(meta.messageIds, m.Id)
+		for _, label := range m.LabelIds {
+			if !labels[label] {
+				labels[label] = true
+				meta.summary.Labels = append(meta.summary.Labels, label)
+			}
+			switch label {
+			case "UNREAD":
+				meta.summary.Unread = true
+			case "STARRED":
+				meta.summary.Flagged = true
+			}
+		}
+		if m.Payload != nil && m.Payload.MimeType == "multipart/mixed" {
+			meta.summary.HasAttachment = true
+		}
+	}
+	return meta
+}
+
+func gmailHeader(m *gmail.Message, name string) string {
+	if m.Payload == nil {
+		return ""
+	}
+	for _, header := range m.Payload.Headers {
+		if strings.EqualFold(header.Name, name) {
+			return header.Value
+		}
+	}
+	return ""
 }
 
 func (gc *GmailClient) GetMessageMetadata(user string, messageId string) (*gmail.Message, error) {
@@ -127,8 +496,8 @@ func (gc *GmailClient) GetMessageMetadata(user string, messageId string) (*gmail
 	return msg, nil
 }
 
-func (gc *GmailClient) GetMessageBody(messageId string) (string, error) {
-	msg, err := gc.Service.Users.Messages.Get("me", messageId).Format("raw").Do()
+func (gc *GmailClient) GetMessageBody(ctx context.Context, messageId string) (string, error) {
+	msg, err := gc.Service.Users.Messages.Get("me", messageId).Format("raw").Context(ctx).Do()
 	if err != nil {
 		return "", err
 	}
@@ -147,6 +516,20 @@ func (gc *GmailClient) GetMessageBody(messageId string) (string, error) {
 	return formattedHeaders + "\n\n" + body, nil
 }
 
+func (gc *GmailClient) GetAttachments(messageId string) ([]Attachment, error) {
+	msg, err := gc.Service.Users.Messages.Get("me", messageId).Format("raw").Do()
+	if err != nil {
+		return nil, err
+	}
+
+	rawData, err := base64.URLEncoding.DecodeString(msg.Raw)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseAttachments(bytes.NewReader(rawData))
+}
+
 func parseMessage(rawData []byte) (map[string]string, string, error) {
 	r := bytes.NewReader(rawData)
 	msg, err := mail.ReadMessage(r)
@@ -246,24 +629,10 @@ func decodeBodyGmail(body, encoding string) (string, error) {
 
 func renderMessageBodyGmail(body, contentType string) (string, error) {
 	if strings.HasPrefix(contentType, "text/html") {
-		doc, err := goquery.NewDocumentFromReader(strings.NewReader(body))
-		if err != nil {
-			return "", err
-		}
-
-		doc.Find("style").Each(func(i int, s *goquery.Selection) {
-			s.Remove()
-		})
-
-		doc.Find("[style]").Each(func(i int, s *goquery.Selection) {
-			s.RemoveAttr("style")
-		})
-
-		renderedHTML := doc.Text()
-		return formatText(renderedHTML), nil
+		return renderHTML(body)
 	}
 
-	return formatText(body), nil
+	return tview.Escape(formatText(body)), nil
 }
 
 func formatText(text string) string {
@@ -291,72 +660,61 @@ func formatHeadersGmail(headers map[string]string) string {
 
 	for _, header := range headerOrder {
 		if value, ok := headers[header]; ok && value != "" {
-			formattedHeaders.WriteString(fmt.Sprintf("%s: %s\n", header, value))
+			formattedHeaders.WriteString(headerLine(header, value) + "\n")
 		}
 	}
 
 	return strings.TrimSpace(formattedHeaders.String())
 }
 
-func getHttpClient(config *oauth2.Config) *http.Client {
+func getHttpClient(config *oauth2.Config) (*http.Client, error) {
 	if baseDir == "" {
 		baseDir = os.Getenv("MAILTERM_HOME")
 	}
-	tokenFile := fmt.Sprintf("%s/gmail.json", baseDir)
-	token, err := tokenFromFile(tokenFile)
+	tokens, err := oauthTokenSource("Gmail", secretGmailToken, config)
 	if err != nil {
-		token = getTokenFromWeb(config)
-		saveToken(tokenFile, token)
+		return nil, err
 	}
-
-	return config.Client(context.Background(), token)
+	return oauth2.NewClient(context.Background(), tokens), nil
 }
 
-func getTokenFromWeb(config *oauth2.Config) *oauth2.Token {
-	channel := make(chan string)
-	server := &http.Server{Addr: ":8080"}
-
-	http.HandleFunc("/callback", func(w http.ResponseWriter, r *http.Request) {
-		code := r.URL.Query().Get("code")
-		channel <- code
-		_, err := fmt.Fprintf(w, "Auth successful! You can now close this window.")
-		if err != nil {
-			_, _ = fmt.Fprintf(w, "Error: %v", err)
-		}
-	})
-
-	go func() {
-		if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
-			log.Fatalf("HTTP server ListenAndServe: %v", err)
-		}
-	}()
-
-	config.RedirectURL = "http://localhost:8080/callback"
-
-	url := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
-	fmt.Printf("Go to the following link in your browser then type the "+
-		"authorization code: \n%v\n", url)
-
-	authCode := <-channel
-
-	go func() {
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-		if err := server.Shutdown(ctx); err != nil {
-			log.Printf("Error shutting down server: %v", err)
-		}
-	}()
+func CheckToken() error {
+	_, err := loadOAuthToken(secretGmailToken)
+	return err
+}
 
-	token, err := config.Exchange(context.TODO(), authCode)
+// loadOAuthToken reads the token stored under key from the secret store, or
+// from its token file if secrets are kept in plain text.
+func loadOAuthToken(key string) (*oauth2.Token, error) {
+	store, err := secrets()
 	if err != nil {
-		log.Fatalf("Unable to retrieve token from web: %v", err)
+		return nil, err
 	}
-	return token
+	if store == nil {
+		return tokenFromFile(fmt.Sprintf("%s/%s", os.Getenv("MAILTERM_HOME"), tokenFiles[key]))
+	}
+	data, err := store.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	token := &oauth2.Token{}
+	err = json.Unmarshal([]byte(data), token)
+	return token, err
 }
 
-func CheckToken() error {
-	_, err := tokenFromFile(fmt.Sprintf("%s/gmail.json", baseDir))
-	return err
+func saveOAuthToken(key string, token *oauth2.Token) error {
+	store, err := secrets()
+	if err != nil {
+		return err
+	}
+	if store == nil {
+		return saveToken(fmt.Sprintf("%s/%s", os.Getenv("MAILTERM_HOME"), tokenFiles[key]), token)
+	}
+	data, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	return store.Set(key, string(data))
 }
 
 func tokenFromFile(file string) (*oauth2.Token, error) {
@@ -376,20 +734,10 @@ func tokenFromFile(file string) (*oauth2.Token, error) {
 	return token, err
 }
 
-func saveToken(path string, token *oauth2.Token) {
-	fmt.Printf("Saving credential file to: %s\n", path)
-	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
-	if err != nil {
-		log.Fatalf("Unable to cache oauth token: %v", err)
-	}
-	defer func(f *os.File) {
-		err := f.Close()
-		if err != nil {
-			return
-		}
-	}(f)
-	err = json.NewEncoder(f).Encode(token)
+func saveToken(path string, token *oauth2.Token) error {
+	data, err := json.Marshal(token)
 	if err != nil {
-		return
+		return err
 	}
+	return writeFileAtomic(path, data, 0600)
 }
@@ -3,11 +3,16 @@ package api
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"net/mail"
 	"os"
+	"strings"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	abstractions "github.com/microsoft/kiota-abstractions-go"
 	auth "github.com/microsoft/kiota-authentication-azure-go"
 	msgraphsdk "github.com/microsoftgraph/msgraph-sdk-go"
+	msgraphcore "github.com/microsoftgraph/msgraph-sdk-go-core"
 	graphmodels "github.com/microsoftgraph/msgraph-sdk-go/models"
 	"github.com/microsoftgraph/msgraph-sdk-go/users"
 )
@@ -72,41 +77,282 @@ func (g *GraphHelper) GetFolders() (graphmodels.MailFolderCollectionResponseable
 	return toReturn, err
 }
 
-func (g *GraphHelper) GetMessages() (graphmodels.MessageCollectionResponseable, error) {
-	_, err := g.getUserId()
+// GetFolderList lists the mail folders as move destinations.
+func (g *GraphHelper) GetFolderList() ([]Folder, error) {
+	result, err := g.GetFolders()
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = g.GetFolders()
+	var folders []Folder
+	for _, f := range result.GetValue() {
+		if f.GetId() == nil || f.GetDisplayName() == nil {
+			continue
+		}
+		folders = append(folders, Folder{Id: *f.GetId(), Name: *f.GetDisplayName()})
+	}
+	return folders, nil
+}
+
+// GetMessages returns one page of the inbox, newest first, or the page at
+// nextLink. A search query limits it to matching messages, in relevance
+// order since Graph cannot sort search results.
+func (g *GraphHelper) GetMessages(ctx context.Context, nextLink string, limit int32, search string) (graphmodels.MessageCollectionResponseable, error) {
+	_, err := g.getUserId()
 	if err != nil {
 		return nil, err
 	}
 
-	var topValue int32 = 25
+	messages := g.service.Users().ByUserId(userId).MailFolders().
+		ByMailFolderId("inbox").
+		Messages()
+	if nextLink != "" {
+		return messages.WithUrl(nextLink).Get(ctx, nil)
+	}
+
 	query := users.ItemMailfoldersItemMessagesRequestBuilderGetQueryParameters{
 		// Only request specific properties
-		Select: []string{"from", "isRead", "receivedDateTime", "subject"},
-		// Get at most 25 results
-		Top: &topValue,
+		Select: []string{"from", "isRead", "receivedDateTime", "subject", "flag", "hasAttachments", "conversationId"},
+		Top:    &limit,
+	}
+	if search != "" {
+		search = `"` + strings.ReplaceAll(search, `"`, "") + `"`
+		query.Search = &search
+	} else {
 		// Sort by received time, newest first
-		Orderby: []string{"receivedDateTime DESC"},
+		query.Orderby = []string{"receivedDateTime DESC"}
 	}
 
-	toReturn, err := g.service.Users().ByUserId(userId).MailFolders().
-		ByMailFolderId("inbox").
-		Messages().
-		Get(context.Background(),
-			&users.ItemMailfoldersItemMessagesRequestBuilderGetRequestConfiguration{
-				QueryParameters: &query,
-			})
+	return messages.Get(ctx,
+		&users.ItemMailfoldersItemMessagesRequestBuilderGetRequestConfiguration{
+			QueryParameters: &query,
+		})
+}
 
+func (g *GraphHelper) GetAttachments(messageId string) ([]Attachment, error) {
+	_, err := g.getUserId()
 	if err != nil {
 		return nil, err
 	}
 
-	return toReturn, err
+	result, err := g.service.Users().ByUserId(userId).Messages().ByMessageId(messageId).
+		Attachments().
+		Get(context.Background(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var attachments []Attachment
+	for _, a := range result.GetValue() {
+		file, ok := a.(graphmodels.FileAttachmentable)
+		if !ok {
+			continue
+		}
+		attachment := Attachment{Data: file.GetContentBytes()}
+		if name := file.GetName(); name != nil {
+			attachment.Filename = *name
+		}
+		if contentType := file.GetContentType(); contentType != nil {
+			attachment.ContentType = *contentType
+		}
+		attachments = append(attachments, attachment)
+	}
+
+	return attachments, nil
+}
+
+// SummarizeGraphMessage describes a Graph message for the message list.
+func SummarizeGraphMessage(m graphmodels.Messageable) MessageSummary {
+	summary := MessageSummary{}
+	if id := m.GetId(); id != nil {
+		summary.Id = *id
+	}
+	if conversation := m.GetConversationId(); conversation != nil {
+		summary.ThreadId = *conversation
+	}
+	if subject := m.GetSubject(); subject != nil {
+		summary.Subject = *subject
+	}
+	if from := m.GetFrom(); from != nil && from.GetEmailAddress() != nil {
+		if name := from.GetEmailAddress().GetName(); name != nil && *name != "" {
+			summary.From = *name
+		} else if address := from.GetEmailAddress().GetAddress(); address != nil {
+			summary.From = *address
+		}
+	}
+	if received := m.GetReceivedDateTime(); received != nil {
+		summary.Date = *received
+	}
+	if isRead := m.GetIsRead(); isRead != nil {
+		summary.Unread = !*isRead
+	}
+	if flag := m.GetFlag(); flag != nil && flag.GetFlagStatus() != nil {
+		summary.Flagged = *flag.GetFlagStatus() == graphmodels.FLAGGED_FOLLOWUPFLAGSTATUS
+	}
+	if hasAttachments := m.GetHasAttachments(); hasAttachments != nil {
+		summary.HasAttachment = *hasAttachments
+	}
+	return summary
+}
+
+// graphBatchLimit is the most requests Graph accepts in one JSON batch.
+const graphBatchLimit = 20
+
+// batch sends one request per message as JSON batches of up to
+// graphBatchLimit requests. done, if set, is called with each message id and
+// its response item.
+func (g *GraphHelper) batch(messageIds []string, build func(messageId string) (*abstractions.RequestInformation, error), done func(messageId string, resp msgraphcore.BatchResponse, itemId string)) error {
+	adapter := g.service.GetAdapter()
+	for len(messageIds) > 0 {
+		n := min(len(messageIds), graphBatchLimit)
+		chunk := messageIds[:n]
+		messageIds = messageIds[n:]
+
+		batch := msgraphcore.NewBatchRequest(adapter)
+		itemIds := make([]string, len(chunk))
+		for i, messageId := range chunk {
+			info, err := build(messageId)
+			if err != nil {
+				return err
+			}
+			item, err := batch.AddBatchRequestStep(*info)
+			if err != nil {
+				return err
+			}
+			itemIds[i] = *item.GetId()
+		}
+
+		resp, err := batch.Send(context.Background(), adapter)
+		if err != nil {
+			return err
+		}
+		if failed := resp.GetFailedResponses(); len(failed) > 0 {
+			return fmt.Errorf("%d of %d requests in the batch failed", len(failed), len(chunk))
+		}
+		if done != nil {
+			for i, messageId := range chunk {
+				done(messageId, resp, itemIds[i])
+			}
+		}
+	}
+	return nil
+}
+
+// patchMessages applies the same update to every message.
+func (g *GraphHelper) patchMessages(update graphmodels.Messageable, messageIds []string) error {
+	_, err := g.getUserId()
+	if err != nil {
+		return err
+	}
+
+	return g.batch(messageIds, func(messageId string) (*abstractions.RequestInformation, error) {
+		return g.service.Users().ByUserId(userId).Messages().ByMessageId(messageId).
+			ToPatchRequestInformation(context.Background(), update, nil)
+	}, nil)
+}
+
+func (g *GraphHelper) SetRead(read bool, messageIds ...string) error {
+	update := graphmodels.NewMessage()
+	update.SetIsRead(&read)
+	return g.patchMessages(update, messageIds)
+}
 
+func (g *GraphHelper) SetFlagged(flagged bool, messageIds ...string) error {
+	status := graphmodels.NOTFLAGGED_FOLLOWUPFLAGSTATUS
+	if flagged {
+		status = graphmodels.FLAGGED_FOLLOWUPFLAGSTATUS
+	}
+	flag := graphmodels.NewFollowupFlag()
+	flag.SetFlagStatus(&status)
+	update := graphmodels.NewMessage()
+	update.SetFlag(flag)
+	return g.patchMessages(update, messageIds)
+}
+
+// MoveMessages moves messages to another folder. Graph gives each moved
+// copy a new id; the new ids are returned in the order of messageIds.
+func (g *GraphHelper) MoveMessages(folderId string, messageIds ...string) ([]string, error) {
+	_, err := g.getUserId()
+	if err != nil {
+		return nil, err
+	}
+
+	body := users.NewItemMessagesItemMovePostRequestBody()
+	body.SetDestinationId(&folderId)
+
+	newIds := make(map[string]string)
+	err = g.batch(messageIds, func(messageId string) (*abstractions.RequestInformation, error) {
+		return g.service.Users().ByUserId(userId).Messages().ByMessageId(messageId).
+			Move().
+			ToPostRequestInformation(context.Background(), body, nil)
+	}, func(messageId string, resp msgraphcore.BatchResponse, itemId string) {
+		moved, err := msgraphcore.GetBatchResponseById[graphmodels.Messageable](resp, itemId, graphmodels.CreateMessageFromDiscriminatorValue)
+		if err == nil && moved != nil && moved.GetId() != nil {
+			newIds[messageId] = *moved.GetId()
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, len(messageIds))
+	for i, messageId := range messageIds {
+		ids[i] = newIds[messageId]
+	}
+	return ids, nil
+}
+
+// ArchiveMessages moves messages to the well-known Archive folder.
+func (g *GraphHelper) ArchiveMessages(messageIds ...string) ([]string, error) {
+	return g.MoveMessages("archive", messageIds...)
+}
+
+// DeleteMessages moves messages to the well-known Deleted Items folder,
+// from where they can still be moved back.
+func (g *GraphHelper) DeleteMessages(messageIds ...string) ([]string, error) {
+	return g.MoveMessages("deleteditems", messageIds...)
+}
+
+// PrepareGraphMessage turns a composed message into a Graph message.
+func PrepareGraphMessage(email Message) *graphmodels.Message {
+	message := graphmodels.NewMessage()
+	message.SetSubject(&email.Subject)
+
+	contentType := graphmodels.TEXT_BODYTYPE
+	body := graphmodels.NewItemBody()
+	body.SetContentType(&contentType)
+	body.SetContent(&email.Body)
+	message.SetBody(body)
+
+	message.SetToRecipients(graphRecipients(email.To))
+	message.SetCcRecipients(graphRecipients(email.Cc))
+	message.SetBccRecipients(graphRecipients(email.Bcc))
+	return message
+}
+
+// graphRecipients parses a comma separated address list. Entries that do
+// not parse are passed on as they are.
+func graphRecipients(list string) []graphmodels.Recipientable {
+	var recipients []graphmodels.Recipientable
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		address := graphmodels.NewEmailAddress()
+		if parsed, err := mail.ParseAddress(entry); err == nil {
+			address.SetAddress(&parsed.Address)
+			if parsed.Name != "" {
+				address.SetName(&parsed.Name)
+			}
+		} else {
+			address.SetAddress(&entry)
+		}
+		recipient := graphmodels.NewRecipient()
+		recipient.SetEmailAddress(address)
+		recipients = append(recipients, recipient)
+	}
+	return recipients
 }
 
 func (g *GraphHelper) SendMessage(message *graphmodels.Message) error {
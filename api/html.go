@@ -0,0 +1,519 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/rivo/tview"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+const (
+	headingStyleEnd = "[-::B]"
+	maxCellWidth    = 60
+	htmlTimeout     = 10 * time.Second
+)
+
+// Colors of rendered messages. The UI sets them from its theme.
+var (
+	HeadingColor       = "yellow"
+	MessageHeaderColor = "-"
+)
+
+// htmlCommand is an external renderer such as "w3m -dump -T text/html" that
+// reads HTML on stdin. It is set from the viewer config by LoadConfig.
+var htmlCommand string
+
+// htmlLinks numbers the hyperlinks of a document so that a table cell
+// rendered on its own shares the footnotes of the whole message.
+type htmlLinks struct {
+	urls  []string
+	index map[string]int
+}
+
+func (l *htmlLinks) add(url string) int {
+	if n, ok := l.index[url]; ok {
+		return n
+	}
+	l.urls = append(l.urls, url)
+	l.index[url] = len(l.urls)
+	return len(l.urls)
+}
+
+type htmlList struct {
+	ordered bool
+	n       int
+}
+
+// htmlRenderer turns an HTML tree into text for the message pane. Output is
+// escaped for tview, with style tags for headings and emphasis.
+type htmlRenderer struct {
+	out       strings.Builder
+	links     *htmlLinks
+	prefix    []string
+	lists     []htmlList
+	breaks    int    // newlines owed before the next text
+	gap       string // prefix for the blank lines among those newlines
+	space     bool   // a collapsed space is owed before the next text
+	started   bool
+	lineStart bool
+	pre       int
+}
+
+func newHTMLRenderer(links *htmlLinks) *htmlRenderer {
+	return &htmlRenderer{links: links}
+}
+
+// renderHTML renders an HTML body into readable text, listing its links as
+// numbered references at the end. A configured external renderer takes
+// precedence; if it fails the built-in renderer is used instead.
+func renderHTML(body string) (string, error) {
+	if htmlCommand != "" {
+		out, err := runHTMLCommand(htmlCommand, body)
+		if err == nil {
+			return tview.Escape(strings.TrimSpace(out)), nil
+		}
+	}
+
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+
+	doc.Find("script, style, head, title, noscript, template, meta, link").Remove()
+
+	// hidden preheaders and tracking pixels
+	doc.Find("[style]").Each(func(i int, s *goquery.Selection) {
+		style := strings.ReplaceAll(strings.ToLower(s.AttrOr("style", "")), " ", "")
+		if strings.Contains(style, "display:none") || strings.Contains(style, "visibility:hidden") {
+			s.Remove()
+		}
+	})
+	doc.Find("img").Each(func(i int, s *goquery.Selection) {
+		if isPixel(s.AttrOr("width", "")) || isPixel(s.AttrOr("height", "")) {
+			s.Remove()
+		}
+	})
+
+	r := newHTMLRenderer(&htmlLinks{index: make(map[string]int)})
+	for _, n := range doc.Nodes {
+		r.walk(n)
+	}
+
+	var result strings.Builder
+	result.WriteString(strings.TrimSpace(r.out.String()))
+	if len(r.links.urls) > 0 {
+		result.WriteString("\n\nLinks:\n")
+		for i, url := range r.links.urls {
+			result.WriteString(tview.Escape(fmt.Sprintf("[%d] %s", i+1, url)))
+			result.WriteString("\n")
+		}
+	}
+
+	return strings.TrimRight(result.String(), "\n"), nil
+}
+
+func runHTMLCommand(command, body string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), htmlTimeout)
+	defer cancel()
+
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Stdin = strings.NewReader(body)
+	cmd.Stdout = &out
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("running %q: %w", command, err)
+	}
+	return out.String(), nil
+}
+
+func isPixel(size string) bool {
+	n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(size), "px"))
+	return err == nil && n <= 1
+}
+
+func (r *htmlRenderer) walk(n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		r.text(n.Data)
+	case html.ElementNode:
+		r.element(n)
+	case html.DocumentNode:
+		r.children(n)
+	}
+}
+
+func (r *htmlRenderer) children(n *html.Node) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		r.walk(c)
+	}
+}
+
+func (r *htmlRenderer) element(n *html.Node) {
+	switch n.DataAtom {
+	case atom.Script, atom.Style, atom.Head, atom.Title, atom.Noscript, atom.Template:
+		return
+	case atom.Br:
+		if r.started && r.breaks < 2 {
+			r.owe(r.breaks + 1)
+		}
+		r.space = false
+	case atom.P, atom.H5, atom.H6, atom.Dl, atom.Figure:
+		r.paragraph()
+		r.children(n)
+		r.paragraph()
+	case atom.H1, atom.H2, atom.H3, atom.H4:
+		r.paragraph()
+		r.tag("[" + HeadingColor + "::b]")
+		r.children(n)
+		r.tag(headingStyleEnd)
+		r.paragraph()
+	case atom.B, atom.Strong:
+		r.styled(n, "[::b]", "[::B]")
+	case atom.I, atom.Em, atom.Cite, atom.Var:
+		r.styled(n, "[::i]", "[::I]")
+	case atom.U, atom.Ins:
+		r.styled(n, "[::u]", "[::U]")
+	case atom.S, atom.Strike, atom.Del:
+		r.styled(n, "[::s]", "[::S]")
+	case atom.Pre:
+		r.paragraph()
+		r.pre++
+		r.children(n)
+		r.pre--
+		r.paragraph()
+	case atom.Blockquote:
+		r.paragraph()
+		r.prefix = append(r.prefix, "> ")
+		r.children(n)
+		r.prefix = r.prefix[:len(r.prefix)-1]
+		r.paragraph()
+	case atom.Ul, atom.Ol:
+		if len(r.lists) == 0 {
+			r.paragraph()
+		} else {
+			r.line()
+		}
+		r.lists = append(r.lists, htmlList{ordered: n.DataAtom == atom.Ol})
+		r.children(n)
+		r.lists = r.lists[:len(r.lists)-1]
+		if len(r.lists) == 0 {
+			r.paragraph()
+		} else {
+			r.line()
+		}
+	case atom.Li:
+		r.listItem(n)
+	case atom.Dd:
+		r.line()
+		r.prefix = append(r.prefix, "    ")
+		r.children(n)
+		r.prefix = r.prefix[:len(r.prefix)-1]
+		r.line()
+	case atom.Table:
+		r.table(n)
+	case atom.A:
+		r.anchor(n)
+	case atom.Img:
+		if alt := strings.TrimSpace(attr(n, "alt")); alt != "" {
+			r.write(fmt.Sprintf("[image: %s]", alt))
+		}
+	case atom.Hr:
+		r.paragraph()
+		r.write(strings.Repeat("─", 40))
+		r.paragraph()
+	case atom.Div, atom.Section, atom.Article, atom.Header, atom.Footer, atom.Main, atom.Nav,
+		atom.Aside, atom.Center, atom.Form, atom.Fieldset, atom.Address, atom.Figcaption,
+		atom.Dt, atom.Tr, atom.Tbody, atom.Thead, atom.Tfoot, atom.Caption:
+		r.line()
+		r.children(n)
+		r.line()
+	default:
+		r.children(n)
+	}
+}
+
+func (r *htmlRenderer) styled(n *html.Node, start, end string) {
+	r.tag(start)
+	r.children(n)
+	r.tag(end)
+}
+
+func (r *htmlRenderer) listItem(n *html.Node) {
+	r.line()
+	marker := "• "
+	if len(r.lists) > 0 {
+		list := &r.lists[len(r.lists)-1]
+		list.n++
+		if list.ordered {
+			marker = fmt.Sprintf("%d. ", list.n)
+		}
+	}
+	r.write(marker)
+	r.space = false
+	r.prefix = append(r.prefix, strings.Repeat(" ", len([]rune(marker))))
+	r.children(n)
+	r.prefix = r.prefix[:len(r.prefix)-1]
+	r.line()
+}
+
+func (r *htmlRenderer) anchor(n *html.Node) {
+	r.children(n)
+
+	href := strings.TrimSpace(attr(n, "href"))
+	if href == "" || strings.HasPrefix(href, "#") || strings.HasPrefix(strings.ToLower(href), "javascript:") {
+		return
+	}
+
+	space := r.space
+	r.space = false
+	r.write(fmt.Sprintf("[%d]", r.links.add(href)))
+	r.space = space
+}
+
+// table lays out data tables as aligned columns. Tables with a single column
+// or nested tables are almost always used for layout, so their cells are
+// rendered as ordinary blocks instead.
+func (r *htmlRenderer) table(n *html.Node) {
+	rows := tableRows(n)
+	if isLayoutTable(rows) {
+		r.line()
+		r.children(n)
+		r.line()
+		return
+	}
+
+	var cells [][][]string
+	var widths []int
+	header := len(rows) > 0
+	for i, row := range rows {
+		var rendered [][]string
+		for j, cell := range row {
+			sub := newHTMLRenderer(r.links)
+			if cell.DataAtom == atom.Th {
+				sub.styled(cell, "[::b]", "[::B]")
+			} else {
+				sub.children(cell)
+				if i == 0 {
+					header = false
+				}
+			}
+
+			var lines []string
+			for _, line := range strings.Split(strings.TrimSpace(sub.out.String()), "\n") {
+				if tview.TaggedStringWidth(line) > maxCellWidth {
+					lines = append(lines, tview.WordWrap(line, maxCellWidth)...)
+				} else {
+					lines = append(lines, line)
+				}
+			}
+			rendered = append(rendered, lines)
+
+			if j >= len(widths) {
+				widths = append(widths, 0)
+			}
+			for _, line := range lines {
+				if w := tview.TaggedStringWidth(line); w > widths[j] {
+					widths[j] = w
+				}
+			}
+		}
+		cells = append(cells, rendered)
+	}
+
+	r.paragraph()
+	for i, row := range cells {
+		height := 0
+		for _, cell := range row {
+			height = max(height, len(cell))
+		}
+		for l := 0; l < height; l++ {
+			var line strings.Builder
+			for j, cell := range row {
+				text := ""
+				if l < len(cell) {
+					text = cell[l]
+				}
+				line.WriteString(text)
+				if j < len(row)-1 {
+					line.WriteString(strings.Repeat(" ", widths[j]-tview.TaggedStringWidth(text)+2))
+				}
+			}
+			r.raw(strings.TrimRight(line.String(), " "))
+			r.line()
+		}
+		if i == 0 && header && len(cells) > 1 {
+			total := 0
+			for _, w := range widths {
+				total += w + 2
+			}
+			r.raw(strings.Repeat("─", total-2))
+			r.line()
+		}
+	}
+	r.paragraph()
+}
+
+func tableRows(table *html.Node) [][]*html.Node {
+	var rows [][]*html.Node
+	var visit func(n *html.Node)
+	visit = func(n *html.Node) {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			switch c.DataAtom {
+			case atom.Thead, atom.Tbody, atom.Tfoot:
+				visit(c)
+			case atom.Tr:
+				var row []*html.Node
+				for cell := c.FirstChild; cell != nil; cell = cell.NextSibling {
+					if cell.DataAtom == atom.Td || cell.DataAtom == atom.Th {
+						row = append(row, cell)
+					}
+				}
+				if len(row) > 0 {
+					rows = append(rows, row)
+				}
+			}
+		}
+	}
+	visit(table)
+	return rows
+}
+
+func isLayoutTable(rows [][]*html.Node) bool {
+	columns := 0
+	for _, row := range rows {
+		columns = max(columns, len(row))
+		for _, cell := range row {
+			if hasDescendant(cell, atom.Table) {
+				return true
+			}
+		}
+	}
+	return columns <= 1
+}
+
+func hasDescendant(n *html.Node, a atom.Atom) bool {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.DataAtom == a || hasDescendant(c, a) {
+			return true
+		}
+	}
+	return false
+}
+
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+func (r *htmlRenderer) text(s string) {
+	if r.pre > 0 {
+		lines := strings.Split(s, "\n")
+		for i, line := range lines {
+			if i > 0 {
+				r.owe(r.breaks + 1)
+			}
+			if line != "" {
+				r.raw(tview.Escape(line))
+			}
+		}
+		return
+	}
+
+	words := strings.Fields(s)
+	if len(words) == 0 {
+		if s != "" {
+			r.space = true
+		}
+		return
+	}
+	if unicode.IsSpace([]rune(s)[0]) {
+		r.space = true
+	}
+	r.write(strings.Join(words, " "))
+	r.space = unicode.IsSpace([]rune(s)[len([]rune(s))-1])
+}
+
+// write emits text, escaping anything tview would read as a style tag.
+func (r *htmlRenderer) write(s string) {
+	r.raw(tview.Escape(s))
+}
+
+// raw emits text that is already escaped, settling owed line breaks and
+// spaces first.
+func (r *htmlRenderer) raw(s string) {
+	r.flush()
+	if r.space && !r.lineStart {
+		r.out.WriteByte(' ')
+	}
+	r.space = false
+	r.out.WriteString(s)
+	r.lineStart = false
+}
+
+// tag emits a style tag without consuming an owed space, so the space ends up
+// on the styled side of the tag.
+func (r *htmlRenderer) tag(s string) {
+	r.flush()
+	r.out.WriteString(s)
+}
+
+func (r *htmlRenderer) flush() {
+	prefix := strings.Join(r.prefix, "")
+	if !r.started {
+		r.out.WriteString(prefix)
+		r.started = true
+		r.lineStart = true
+		r.breaks = 0
+		return
+	}
+	if r.breaks == 0 {
+		return
+	}
+	for i := 0; i < r.breaks; i++ {
+		r.out.WriteByte('\n')
+		if i < r.breaks-1 {
+			r.out.WriteString(strings.TrimRight(r.gap, " "))
+		}
+	}
+	r.out.WriteString(prefix)
+	r.breaks = 0
+	r.space = false
+	r.lineStart = true
+}
+
+// owe records n pending newlines. Blank lines take the shallowest prefix seen
+// since the last text, so the gap before a blockquote is not itself quoted.
+func (r *htmlRenderer) owe(n int) {
+	prefix := strings.Join(r.prefix, "")
+	if r.breaks == 0 || len(prefix) < len(r.gap) {
+		r.gap = prefix
+	}
+	r.breaks = n
+}
+
+// line ends the current line, if any.
+func (r *htmlRenderer) line() {
+	if r.started && !r.lineStart && r.breaks < 1 {
+		r.owe(1)
+	}
+}
+
+// paragraph leaves a blank line before the next text.
+func (r *htmlRenderer) paragraph() {
+	if r.started {
+		r.owe(2)
+	}
+}
@@ -0,0 +1,72 @@
+package api
+
+import "testing"
+
+func TestRenderHTML(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{
+			"paragraphs and emphasis",
+			`<p>Hello <b>world</b></p><p>Second   paragraph</p>`,
+			"Hello[::b] world[::B]\n\nSecond paragraph",
+		},
+		{
+			"heading",
+			`<h1>Title</h1><p>Body</p>`,
+			"[yellow::b]Title[-::B]\n\nBody",
+		},
+		{
+			"lists",
+			`<ul><li>one</li><li>two</li></ul><ol><li>a</li><li>b</li></ol>`,
+			"• one\n• two\n\n1. a\n2. b",
+		},
+		{
+			"links share a footnote",
+			`<p>See <a href="https://example.com/x">the site</a> and <a href="https://example.com/x">again</a>.</p>`,
+			"See the site[1[] and again[1[].\n\nLinks:\n[1[] https://example.com/x",
+		},
+		{
+			"hidden preheader, tracking pixel and script",
+			`<div style="display: none">preheader</div><p>Shown<img src="t.gif" width="1" height="1"></p><script>alert(1)</script>`,
+			"Shown",
+		},
+		{
+			"blockquote",
+			`<blockquote><p>quoted</p></blockquote><p>reply</p>`,
+			"> quoted\n\nreply",
+		},
+		{
+			"text that looks like a style tag",
+			`<p>[red]not a tag[-]</p>`,
+			"[red[]not a tag[-[]",
+		},
+		{
+			"preformatted",
+			"<pre>a  b\n  c</pre>",
+			"a  b\n  c",
+		},
+		{
+			"table",
+			`<table><tr><td>Name</td><td>Qty</td></tr><tr><td>Apple</td><td>3</td></tr></table>`,
+			"Name   Qty\nApple  3",
+		},
+		{
+			"line break",
+			`line one<br>line two`,
+			"line one\nline two",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := renderHTML(tt.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("renderHTML(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
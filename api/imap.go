@@ -2,61 +2,101 @@ package api
 
 import (
 	"encoding/base64"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"mime"
 	"mime/multipart"
 	"mime/quotedprintable"
 	"net/mail"
-	"os"
-	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
-	"github.com/PuerkitoBio/goquery"
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/commands"
+	"github.com/rivo/tview"
+	"golang.org/x/oauth2"
 )
 
 type IMAP struct {
-	conn *client.Client
+	// mu keeps commands from different goroutines from interleaving; the
+	// exported methods hold it for their whole exchange with the server.
+	mu      sync.Mutex
+	conn    *client.Client
+	mailbox string
+	config  *Config
+	tokens  oauth2.TokenSource // nil unless the account logs in with OAuth
+	timeout time.Duration
+	watch   *time.Timer // the watchdog of the running request
+
+	// the connection status is kept apart from mu, so that it can be read
+	// while a command is running
+	statusMu sync.Mutex
+	status   ConnStatus
+	onStatus func(ConnStatus)
+	done     chan struct{} // closed by Close to stop the maintainer
 }
 
-func NewIMAPClient() (*IMAP, error) {
-	file, err := os.ReadFile("config.json")
-	if err != nil {
-		return nil, err
-	}
+// trashNames and archiveNames are tried, in order, when no mailbox has the
+// matching special-use attribute.
+var (
+	trashNames   = []string{"Trash", "[Gmail]/Trash", "Deleted Items", "Deleted Messages", "INBOX.Trash"}
+	archiveNames = []string{"Archive", "Archives", "[Gmail]/All Mail", "INBOX.Archive"}
+)
 
-	var credentials Config
+// errNoMailbox is returned by findMailbox when the server has no such
+// mailbox, as opposed to failing to list them.
+var errNoMailbox = errors.New("mailbox not found")
 
-	err = json.Unmarshal(file, &credentials)
+func NewIMAPClient() (*IMAP, error) {
+	config, err := LoadConfig()
 	if err != nil {
 		return nil, err
 	}
 
-	c, err := client.DialTLS(credentials.IMAP.Server, nil)
+	tokens, err := imapTokenSource(config)
 	if err != nil {
 		return nil, err
 	}
-
-	if err := c.Login(credentials.IMAP.Username, credentials.IMAP.Password); err != nil {
-		err := os.Remove(fmt.Sprintf("%s/gmail.json", baseDir))
-		if err != nil {
-			return nil, err
-		}
+	c, err := connectIMAP(config, tokens)
+	if err != nil {
 		return nil, err
 	}
 
-	return &IMAP{conn: c}, nil
+	e := &IMAP{conn: c, config: config, tokens: tokens, timeout: imapTimeout(config.IMAP), done: make(chan struct{})}
+	go e.maintain()
+	return e, nil
 }
 
+// Close logs out and stops reconnecting.
 func (e *IMAP) Close() error {
+	select {
+	case <-e.done:
+	default:
+		close(e.done)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.conn.State() == imap.LogoutState {
+		return nil
+	}
 	return e.conn.Logout()
 }
 
 func (e *IMAP) GetMailboxes() ([]*imap.MailboxInfo, error) {
+	e.mu.Lock()
+	defer e.unlock()
+	if err := e.connected(); err != nil {
+		return nil, err
+	}
+	return e.listMailboxes()
+}
+
+func (e *IMAP) listMailboxes() ([]*imap.MailboxInfo, error) {
 	mailboxes := make(chan *imap.MailboxInfo, 10)
 	done := make(chan error, 1)
 	go func() {
@@ -75,40 +115,123 @@ func (e *IMAP) GetMailboxes() ([]*imap.MailboxInfo, error) {
 }
 
 func (e *IMAP) SelectMailbox(name string) error {
+	e.mu.Lock()
+	defer e.unlock()
+	if err := e.connected(); err != nil {
+		return err
+	}
+	return e.selectMailbox(name)
+}
+
+func (e *IMAP) selectMailbox(name string) error {
 	_, err := e.conn.Select(name, false)
-	return err
+	if err != nil {
+		return err
+	}
+	e.mailbox = name
+	return nil
 }
 
-func (e *IMAP) FetchMessages(limit int) ([]*imap.Message, error) {
-	criteria := imap.NewSearchCriteria()
-	criteria.WithoutFlags = []string{imap.DeletedFlag}
+// GetFolders lists the selectable mailboxes as move destinations.
+func (e *IMAP) GetFolders() ([]Folder, error) {
+	e.mu.Lock()
+	defer e.unlock()
+	if err := e.connected(); err != nil {
+		return nil, err
+	}
+	boxes, err := e.listMailboxes()
+	if err != nil {
+		return nil, err
+	}
+
+	var folders []Folder
+	for _, box := range boxes {
+		selectable := true
+		for _, a := range box.Attributes {
+			if strings.EqualFold(a, imap.NoSelectAttr) {
+				selectable = false
+			}
+		}
+		if selectable {
+			folders = append(folders, Folder{Id: box.Name, Name: box.Name})
+		}
+	}
+	return folders, nil
+}
+
+// findMailbox returns the mailbox with the given special-use attribute
+// (RFC 6154), falling back to the first mailbox matching one of names.
+func (e *IMAP) findMailbox(attr string, names ...string) (string, error) {
+	boxes, err := e.listMailboxes()
+	if err != nil {
+		return "", err
+	}
+
+	for _, box := range boxes {
+		for _, a := range box.Attributes {
+			if strings.EqualFold(a, attr) {
+				return box.Name, nil
+			}
+		}
+	}
+	for _, name := range names {
+		for _, box := range boxes {
+			if strings.EqualFold(box.Name, name) {
+				return box.Name, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no %s %w", attr, errNoMailbox)
+}
+
+// FetchMessages returns up to limit messages, newest first, with UIDs below
+// before. A before of 0 starts from the newest message.
+func (e *IMAP) FetchMessages(limit int, before uint32, query string) ([]*imap.Message, error) {
+	e.mu.Lock()
+	defer e.unlock()
+	if err := e.connected(); err != nil {
+		return nil, err
+	}
 
 	if e.conn.State() != imap.SelectedState {
-		err := e.SelectMailbox("INBOX")
+		err := e.selectMailbox("INBOX")
 		if err != nil {
 			return nil, err
 		} // default to inbox
 	}
 
-	status, err := e.conn.Status("INBOX", []imap.StatusItem{imap.StatusMessages})
+	criteria := searchCriteria(query)
+	criteria.WithoutFlags = append(criteria.WithoutFlags, imap.DeletedFlag)
+	if before > 0 {
+		if before == 1 {
+			return nil, nil
+		}
+		criteria.Uid = new(imap.SeqSet)
+		criteria.Uid.AddRange(1, before-1)
+	}
+
+	uids, err := e.conn.UidSearch(criteria)
 	if err != nil {
 		return nil, err
 	}
-	totalMessages := status.Messages
+	if len(uids) == 0 {
+		return nil, nil
+	}
 
-	from := uint32(1)
-	if totalMessages > uint32(limit) {
-		from = totalMessages - uint32(limit) + 1
+	sort.Slice(uids, func(i, j int) bool {
+		return uids[i] > uids[j]
+	})
+	if limit > 0 && len(uids) > limit {
+		uids = uids[:limit]
 	}
 
-	seqSet := new(imap.SeqSet)
-	seqSet.AddRange(from, totalMessages)
+	seqSet := uidSet(uids)
 
 	messages := make(chan *imap.Message, 10)
 	done := make(chan error, 1)
 
 	go func() {
-		done <- e.conn.Fetch(seqSet, []imap.FetchItem{imap.FetchUid, imap.FetchEnvelope, imap.FetchBodyStructure}, messages)
+		done <- e.conn.UidFetch(seqSet, []imap.FetchItem{imap.FetchUid, imap.FetchFlags, imap.FetchEnvelope, imap.FetchBodyStructure}, messages)
 	}()
 
 	var msgs []*imap.Message
@@ -124,18 +247,115 @@ func (e *IMAP) FetchMessages(limit int) ([]*imap.Message, error) {
 		return msgs[i].Uid > msgs[j].Uid
 	})
 
-	if limit > 0 && len(msgs) > limit {
-		msgs = msgs[:limit]
+	return msgs, nil
+}
+
+// searchCriteria turns a search in the style of Gmail's into IMAP search
+// criteria. It understands from:, to:, cc:, subject: and is:unread, is:read,
+// is:flagged or is:starred; other words are searched for anywhere in the
+// message. Double quotes group words.
+func searchCriteria(query string) *imap.SearchCriteria {
+	criteria := imap.NewSearchCriteria()
+	for _, term := range searchTerms(query) {
+		field, value, ok := strings.Cut(term, ":")
+		if !ok || value == "" {
+			criteria.Text = append(criteria.Text, term)
+			continue
+		}
+		switch strings.ToLower(field) {
+		case "from", "to", "cc", "subject":
+			criteria.Header.Add(field, value)
+		case "is":
+			switch strings.ToLower(value) {
+			case "unread":
+				criteria.WithoutFlags = append(criteria.WithoutFlags, imap.SeenFlag)
+			case "read":
+				criteria.WithFlags = append(criteria.WithFlags, imap.SeenFlag)
+			case "flagged", "starred":
+				criteria.WithFlags = append(criteria.WithFlags, imap.FlaggedFlag)
+			default:
+				criteria.Text = append(criteria.Text, term)
+			}
+		default:
+			criteria.Text = append(criteria.Text, term)
+		}
 	}
+	return criteria
+}
 
-	return msgs, nil
+// searchTerms splits a query at spaces outside double quotes and drops the
+// quotes.
+func searchTerms(query string) []string {
+	var terms []string
+	var term strings.Builder
+	quoted := false
+	for _, r := range query {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == ' ' && !quoted:
+			if term.Len() > 0 {
+				terms = append(terms, term.String())
+				term.Reset()
+			}
+		default:
+			term.WriteRune(r)
+		}
+	}
+	if term.Len() > 0 {
+		terms = append(terms, term.String())
+	}
+	return terms
+}
+
+// SummarizeIMAPMessage describes a message fetched by FetchMessages for the
+// message list.
+func SummarizeIMAPMessage(m *imap.Message) MessageSummary {
+	summary := MessageSummary{
+		Id:     strconv.Itoa(int(m.Uid)),
+		Unread: true,
+	}
+	if m.Envelope != nil {
+		summary.Subject = m.Envelope.Subject
+		summary.Date = m.Envelope.Date
+		if len(m.Envelope.From) > 0 {
+			from := m.Envelope.From[0]
+			summary.From = from.PersonalName
+			if summary.From == "" {
+				summary.From = from.Address()
+			}
+		}
+	}
+	for _, flag := range m.Flags {
+		switch flag {
+		case imap.SeenFlag:
+			summary.Unread = false
+		case imap.FlaggedFlag:
+			summary.Flagged = true
+		}
+	}
+	if m.BodyStructure != nil {
+		m.BodyStructure.Walk(func(path []int, part *imap.BodyStructure) bool {
+			if filename, _ := part.Filename(); filename != "" || strings.EqualFold(part.Disposition, "attachment") {
+				summary.HasAttachment = true
+			}
+			return !summary.HasAttachment
+		})
+	}
+	return summary
 }
 
 func (e *IMAP) GetMessageBody(uid uint32) (string, error) {
-	seqSet := new(imap.SeqSet)
-	seqSet.AddNum(uid)
+	e.mu.Lock()
+	defer e.unlock()
+	if err := e.connected(); err != nil {
+		return "", err
+	}
 
-	section := &imap.BodySectionName{}
+	seqSet := uidSet([]uint32{uid})
+
+	// BODY.PEEK[] leaves \Seen alone; marking read is up to the caller
+	section := &imap.BodySectionName{Peek: true}
 	items := []imap.FetchItem{section.FetchItem()}
 
 	messages := make(chan *imap.Message, 1)
@@ -148,6 +368,9 @@ func (e *IMAP) GetMessageBody(uid uint32) (string, error) {
 	if err := <-done; err != nil {
 		return "", err
 	}
+	if msg == nil {
+		return "", fmt.Errorf("message %d not found", uid)
+	}
 
 	r := msg.GetBody(section)
 	if r == nil {
@@ -180,6 +403,42 @@ func (e *IMAP) GetMessageBody(uid uint32) (string, error) {
 	return headers + "\n\n" + body, nil
 }
 
+// GetAttachments returns the attachments of a message without marking it
+// as seen.
+func (e *IMAP) GetAttachments(uid uint32) ([]Attachment, error) {
+	e.mu.Lock()
+	defer e.unlock()
+	if err := e.connected(); err != nil {
+		return nil, err
+	}
+
+	seqSet := uidSet([]uint32{uid})
+
+	section := &imap.BodySectionName{Peek: true}
+	items := []imap.FetchItem{section.FetchItem()}
+
+	messages := make(chan *imap.Message, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- e.conn.UidFetch(seqSet, items, messages)
+	}()
+
+	msg := <-messages
+	if err := <-done; err != nil {
+		return nil, err
+	}
+	if msg == nil {
+		return nil, fmt.Errorf("message %d not found", uid)
+	}
+
+	r := msg.GetBody(section)
+	if r == nil {
+		return nil, fmt.Errorf("no message body")
+	}
+
+	return parseAttachments(r)
+}
+
 func handleMultipart(r io.Reader, boundary string) (string, error) {
 	mr := multipart.NewReader(r, boundary)
 	var result strings.Builder
@@ -248,56 +507,151 @@ func decodeBody(body, encoding string) (string, error) {
 
 func renderImapMessage(body, contentType string) (string, error) {
 	if strings.HasPrefix(contentType, "text/html") {
-		doc, err := goquery.NewDocumentFromReader(strings.NewReader(body))
-		if err != nil {
-			return "", err
-		}
+		return renderHTML(body)
+	}
 
-		doc.Find("style").Each(func(i int, s *goquery.Selection) {
-			s.Remove()
-		})
+	return tview.Escape(body), nil
+}
 
-		doc.Find("[style]").Each(func(i int, s *goquery.Selection) {
-			s.RemoveAttr("style")
-		})
+func formatHeaders(header mail.Header) string {
+	var lines []string
+	for _, name := range []string{"From", "To", "Cc", "Date", "Subject"} {
+		lines = append(lines, headerLine(name, header.Get(name)))
+	}
+	return strings.Join(lines, "\n")
+}
 
-		renderedHTML := doc.Text()
+// headerLine shows one message header, its name in the header color.
+func headerLine(name, value string) string {
+	return fmt.Sprintf("[%s::b]%s:[-::B] %s", MessageHeaderColor, name, tview.Escape(value))
+}
 
-		renderedHTML = regexp.MustCompile(`\s+`).ReplaceAllString(renderedHTML, " ")
-		renderedHTML = regexp.MustCompile(`\n\s*\n`).ReplaceAllString(renderedHTML, "\n\n")
-		renderedHTML = strings.TrimSpace(renderedHTML)
+func uidSet(uids []uint32) *imap.SeqSet {
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uids...)
+	return seqSet
+}
 
-		return renderedHTML, nil
+// DeleteMessage moves messages to the Trash mailbox. Messages already in the
+// Trash, or on servers without one, are removed permanently.
+func (e *IMAP) DeleteMessage(uids ...uint32) error {
+	e.mu.Lock()
+	defer e.unlock()
+	if err := e.connected(); err != nil {
+		return err
 	}
 
-	return body, nil
+	trash, err := e.findMailbox(imap.TrashAttr, trashNames...)
+	if errors.Is(err, errNoMailbox) || err == nil && trash == e.mailbox {
+		return e.expungeMessages(uids)
+	}
+	if err != nil {
+		return err
+	}
+	return e.moveMessages(trash, uids)
 }
 
-func formatHeaders(header mail.Header) string {
-	return fmt.Sprintf("From: %s\nTo: %s\nCc: %s\nDate: %s\nSubject: %s",
-		header.Get("From"), header.Get("To"), header.Get("Cc"), header.Get("Date"), header.Get("Subject"))
+// ArchiveMessages moves messages to the Archive mailbox.
+func (e *IMAP) ArchiveMessages(uids ...uint32) error {
+	e.mu.Lock()
+	defer e.unlock()
+	if err := e.connected(); err != nil {
+		return err
+	}
+
+	archive, err := e.findMailbox(imap.ArchiveAttr, archiveNames...)
+	if err != nil {
+		return err
+	}
+	return e.moveMessages(archive, uids)
 }
 
-func (e *IMAP) DeleteMessage(uid uint32) error {
-	seqSet := new(imap.SeqSet)
-	seqSet.AddNum(uid)
+// MoveMessages moves messages to another mailbox. Without the MOVE extension
+// they are copied, flagged \Deleted and expunged instead.
+func (e *IMAP) MoveMessages(dest string, uids ...uint32) error {
+	e.mu.Lock()
+	defer e.unlock()
+	if err := e.connected(); err != nil {
+		return err
+	}
+	return e.moveMessages(dest, uids)
+}
+
+func (e *IMAP) moveMessages(dest string, uids []uint32) error {
+	if ok, err := e.conn.Support("MOVE"); err != nil {
+		return err
+	} else if ok {
+		return e.conn.UidMove(uidSet(uids), dest)
+	}
+
+	if err := e.conn.UidCopy(uidSet(uids), dest); err != nil {
+		return err
+	}
+	return e.expungeMessages(uids)
+}
 
+// expungeMessages flags messages \Deleted and expunges them. With UIDPLUS
+// only these messages are expunged; otherwise a plain EXPUNGE also removes
+// any other message already flagged \Deleted in the mailbox.
+func (e *IMAP) expungeMessages(uids []uint32) error {
 	item := imap.FormatFlagsOp(imap.AddFlags, true)
 	flags := []interface{}{imap.DeletedFlag}
+	if err := e.conn.UidStore(uidSet(uids), item, flags, nil); err != nil {
+		return err
+	}
+
+	if ok, err := e.conn.Support("UIDPLUS"); err != nil {
+		return err
+	} else if !ok {
+		return e.conn.Expunge(nil)
+	}
 
-	return e.conn.Store(seqSet, item, flags, nil)
+	cmd := &commands.Uid{Cmd: &imap.Command{
+		Name:      "EXPUNGE",
+		Arguments: []interface{}{uidSet(uids)},
+	}}
+	status, err := e.conn.Execute(cmd, nil)
+	if err != nil {
+		return err
+	}
+	return status.Err()
 }
 
+// SearchMessages returns the UIDs of messages matching criteria.
 func (e *IMAP) SearchMessages(criteria *imap.SearchCriteria) ([]uint32, error) {
-	return e.conn.Search(criteria)
+	e.mu.Lock()
+	defer e.unlock()
+	if err := e.connected(); err != nil {
+		return nil, err
+	}
+	return e.conn.UidSearch(criteria)
 }
 
-func (e *IMAP) MarkAsRead(uid uint32) error {
-	seqSet := new(imap.SeqSet)
-	seqSet.AddNum(uid)
+func (e *IMAP) MarkAsRead(uids ...uint32) error {
+	return e.setFlag(imap.SeenFlag, true, uids)
+}
 
-	item := imap.FormatFlagsOp(imap.AddFlags, true)
-	flags := []interface{}{imap.SeenFlag}
+func (e *IMAP) MarkAsUnread(uids ...uint32) error {
+	return e.setFlag(imap.SeenFlag, false, uids)
+}
+
+func (e *IMAP) SetFlagged(flagged bool, uids ...uint32) error {
+	return e.setFlag(imap.FlaggedFlag, flagged, uids)
+}
+
+func (e *IMAP) setFlag(flag string, on bool, uids []uint32) error {
+	e.mu.Lock()
+	defer e.unlock()
+	if err := e.connected(); err != nil {
+		return err
+	}
+
+	op := imap.FlagsOp(imap.AddFlags)
+	if !on {
+		op = imap.RemoveFlags
+	}
+	item := imap.FormatFlagsOp(op, true)
+	flags := []interface{}{flag}
 
-	return e.conn.Store(seqSet, item, flags, nil)
+	return e.conn.UidStore(uidSet(uids), item, flags, nil)
 }
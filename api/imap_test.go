@@ -0,0 +1,89 @@
+package api
+
+import (
+	"net/textproto"
+	"reflect"
+	"testing"
+
+	"github.com/emersion/go-imap"
+)
+
+func TestSearchTerms(t *testing.T) {
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", nil},
+		{"   ", nil},
+		{"hello world", []string{"hello", "world"}},
+		{"  spaced   out  ", []string{"spaced", "out"}},
+		{`subject:"weekly report" draft`, []string{"subject:weekly report", "draft"}},
+		{`"exact phrase"`, []string{"exact phrase"}},
+		{`"unterminated quote`, []string{"unterminated quote"}},
+	}
+	for _, tt := range tests {
+		if got := searchTerms(tt.query); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("searchTerms(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestSearchCriteria(t *testing.T) {
+	tests := []struct {
+		query        string
+		header       textproto.MIMEHeader
+		withFlags    []string
+		withoutFlags []string
+		text         []string
+	}{
+		{
+			query: "invoice",
+			text:  []string{"invoice"},
+		},
+		{
+			query:  "from:alice@example.com to:bob CC:carol",
+			header: textproto.MIMEHeader{"From": {"alice@example.com"}, "To": {"bob"}, "Cc": {"carol"}},
+		},
+		{
+			query:  `subject:"quarterly numbers" budget`,
+			header: textproto.MIMEHeader{"Subject": {"quarterly numbers"}},
+			text:   []string{"budget"},
+		},
+		{
+			query:        "is:unread",
+			withoutFlags: []string{imap.SeenFlag},
+		},
+		{
+			query:     "is:read is:Starred",
+			withFlags: []string{imap.SeenFlag, imap.FlaggedFlag},
+		},
+		{
+			query:     "is:flagged is:spam",
+			withFlags: []string{imap.FlaggedFlag},
+			text:      []string{"is:spam"},
+		},
+		{
+			query: "from: re:meeting http://example.com",
+			text:  []string{"from:", "re:meeting", "http://example.com"},
+		},
+	}
+	for _, tt := range tests {
+		got := searchCriteria(tt.query)
+		header := tt.header
+		if header == nil {
+			header = textproto.MIMEHeader{}
+		}
+		if !reflect.DeepEqual(got.Header, header) {
+			t.Errorf("searchCriteria(%q).Header = %v, want %v", tt.query, got.Header, header)
+		}
+		if !reflect.DeepEqual(got.WithFlags, tt.withFlags) {
+			t.Errorf("searchCriteria(%q).WithFlags = %q, want %q", tt.query, got.WithFlags, tt.withFlags)
+		}
+		if !reflect.DeepEqual(got.WithoutFlags, tt.withoutFlags) {
+			t.Errorf("searchCriteria(%q).WithoutFlags = %q, want %q", tt.query, got.WithoutFlags, tt.withoutFlags)
+		}
+		if !reflect.DeepEqual(got.Text, tt.text) {
+			t.Errorf("searchCriteria(%q).Text = %q, want %q", tt.query, got.Text, tt.text)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package api
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-sasl"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"golang.org/x/oauth2/microsoft"
+)
+
+// The XOAUTH2 mechanism name.
+const xoauth2 = "XOAUTH2"
+
+// imapAuthenticate logs c in with the mechanism the account is set up for.
+// tokens is only used for the OAuth mechanisms.
+func imapAuthenticate(c *client.Client, config *Config, tokens oauth2.TokenSource) error {
+	account := config.IMAP
+	var mech sasl.Client
+	switch strings.ToLower(account.Auth) {
+	case "", "login":
+		password, err := config.IMAPPassword()
+		if err != nil {
+			return err
+		}
+		return c.Login(account.Username, password)
+	case "xoauth2", "oauthbearer":
+		token, err := tokens.Token()
+		if err != nil {
+			return fmt.Errorf("getting IMAP OAuth token: %w", err)
+		}
+		if strings.EqualFold(account.Auth, xoauth2) {
+			mech = &xoauth2Client{username: account.Username, token: token.AccessToken}
+		} else {
+			host, port := imapAddress(account)
+			portNumber, _ := strconv.Atoi(port)
+			mech = &oauthBearerClient{Client: sasl.NewOAuthBearerClient(&sasl.OAuthBearerOptions{
+				Username: account.Username,
+				Token:    token.AccessToken,
+				Host:     host,
+				Port:     portNumber,
+			})}
+		}
+	default:
+		return fmt.Errorf("unknown IMAP auth %q; use login, xoauth2 or oauthbearer", account.Auth)
+	}
+
+	name := strings.ToUpper(account.Auth)
+	if ok, err := c.SupportAuth(name); err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("the IMAP server does not support %s", name)
+	}
+	err := c.Authenticate(mech)
+	if f, ok := mech.(interface{ failed() error }); ok && err != nil && f.failed() != nil {
+		return fmt.Errorf("%w: %w", err, f.failed())
+	}
+	return err
+}
+
+// imapTokenSource returns the source of OAuth tokens of an IMAP account that
+// logs in with one, or nil for one that logs in with a password.
+func imapTokenSource(config *Config) (oauth2.TokenSource, error) {
+	switch strings.ToLower(config.IMAP.Auth) {
+	case "", "login":
+		return nil, nil
+	}
+	oauthConfig, err := imapOAuthConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens, err := oauthTokenSource("IMAP", secretIMAPToken, oauthConfig)
+	if err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func imapOAuthConfig(config *Config) (*oauth2.Config, error) {
+	o := config.IMAP.OAuth
+	switch strings.ToLower(o.Provider) {
+	case "gmail", "google":
+		b, err := os.ReadFile("client_secret.json")
+		if err != nil {
+			return nil, fmt.Errorf("unable to read client secret file %v", err)
+		}
+		return google.ConfigFromJSON(b, "https://mail.google.com/")
+	case "microsoft":
+		clientId := cmp.Or(o.ClientId, config.Graph.ClientId)
+		if clientId == "" {
+			return nil, fmt.Errorf("imap oauth: no client_id for Microsoft")
+		}
+		scopes := o.Scopes
+		if len(scopes) == 0 {
+			scopes = []string{"https://outlook.office.com/IMAP.AccessAsUser.All", "offline_access"}
+		}
+		return &oauth2.Config{
+			ClientID:     clientId,
+			ClientSecret: o.ClientSecret,
+			Endpoint:     microsoft.AzureADEndpoint(cmp.Or(o.Tenant, config.Graph.TenantID, "common")),
+			Scopes:       scopes,
+		}, nil
+	case "":
+		if o.ClientId == "" || o.AuthURL == "" || o.TokenURL == "" {
+			return nil, fmt.Errorf("imap oauth: set provider to gmail or microsoft, or give client_id, auth_url and token_url")
+		}
+		return &oauth2.Config{
+			ClientID:     o.ClientId,
+			ClientSecret: o.ClientSecret,
+			Endpoint:     oauth2.Endpoint{AuthURL: o.AuthURL, TokenURL: o.TokenURL},
+			Scopes:       o.Scopes,
+		}, nil
+	}
+	return nil, fmt.Errorf("imap oauth: unknown provider %q", o.Provider)
+}
+
+// xoauth2Client is the XOAUTH2 mechanism of Gmail and Microsoft 365, which
+// go-sasl does not have.
+type xoauth2Client struct {
+	username, token string
+	failure         error // why the server rejected the token, if it said
+}
+
+func (a *xoauth2Client) Start() (mech string, ir []byte, err error) {
+	return xoauth2, []byte("user=" + a.username + "\x01auth=Bearer " + a.token + "\x01\x01"), nil
+}
+
+// Next handles the only challenge XOAUTH2 has, which is the server saying
+// why it rejected the token. It is answered with an empty response, after
+// which the server fails the command; an error here would instead cancel
+// the exchange and lose the reason.
+func (a *xoauth2Client) Next(challenge []byte) ([]byte, error) {
+	a.failure = saslFailure(xoauth2, challenge)
+	return []byte{}, nil
+}
+
+func (a *xoauth2Client) failed() error { return a.failure }
+
+// oauthBearerClient is go-sasl's OAUTHBEARER mechanism, except that the
+// error challenge is answered with the dummy response RFC 7628 asks for
+// rather than by cancelling the exchange.
+type oauthBearerClient struct {
+	sasl.Client
+	failure error
+}
+
+func (a *oauthBearerClient) Next(challenge []byte) ([]byte, error) {
+	a.failure = saslFailure(sasl.OAuthBearer, challenge)
+	return []byte{0x01}, nil
+}
+
+func (a *oauthBearerClient) failed() error { return a.failure }
+
+// saslFailure describes the JSON error challenge of an OAuth mechanism.
+func saslFailure(mech string, challenge []byte) error {
+	var status sasl.OAuthBearerError
+	if err := json.Unmarshal(challenge, &status); err != nil {
+		return fmt.Errorf("%s authentication failed: %s", mech, challenge)
+	}
+	return fmt.Errorf("%s authentication error (%s, scope %q)", mech, status.Status, status.Scope)
+}
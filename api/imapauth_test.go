@@ -0,0 +1,179 @@
+package api
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/client"
+	"golang.org/x/oauth2"
+)
+
+// saslExchange is what the fake server saw of an AUTHENTICATE command.
+type saslExchange struct {
+	mech     string
+	initial  string
+	response string // the answer to the error challenge, if one was sent
+}
+
+// fakeSASLServer accepts one connection and answers AUTHENTICATE with OK,
+// or, if reject is set, with an error challenge and then NO.
+func fakeSASLServer(t *testing.T, reject string) (addr string, exchange <-chan saslExchange) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	exchanges := make(chan saslExchange, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		r := bufio.NewReader(conn)
+		fmt.Fprint(conn, "* OK [CAPABILITY IMAP4rev1 SASL-IR AUTH=XOAUTH2 AUTH=OAUTHBEARER] ready\r\n")
+
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			fields := strings.Fields(line)
+			if len(fields) < 2 {
+				continue
+			}
+			tag, command := fields[0], strings.ToUpper(fields[1])
+			switch {
+			case command == "CAPABILITY":
+				fmt.Fprintf(conn, "* CAPABILITY IMAP4rev1 SASL-IR AUTH=XOAUTH2 AUTH=OAUTHBEARER\r\n%s OK done\r\n", tag)
+			case command == "AUTHENTICATE" && len(fields) == 4:
+				ir, _ := base64.StdEncoding.DecodeString(fields[3])
+				e := saslExchange{mech: fields[2], initial: string(ir)}
+				if reject == "" {
+					exchanges <- e
+					fmt.Fprintf(conn, "%s OK authenticated\r\n", tag)
+					continue
+				}
+				fmt.Fprintf(conn, "+ %s\r\n", base64.StdEncoding.EncodeToString([]byte(reject)))
+				answer, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				response, _ := base64.StdEncoding.DecodeString(strings.TrimSpace(answer))
+				e.response = string(response)
+				exchanges <- e
+				fmt.Fprintf(conn, "%s NO invalid credentials\r\n", tag)
+			default:
+				fmt.Fprintf(conn, "%s BAD unexpected\r\n", tag)
+			}
+		}
+	}()
+	return l.Addr().String(), exchanges
+}
+
+func TestIMAPAuthenticateOAuth(t *testing.T) {
+	const failure = `{"status":"401","schemes":"bearer","scope":"https://mail.google.com/"}`
+	tokens := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "tok"})
+
+	tests := []struct {
+		auth     string
+		reject   string
+		initial  func(host, port string) string
+		response string
+	}{
+		{
+			auth:    "xoauth2",
+			initial: func(string, string) string { return "user=me@example.com\x01auth=Bearer tok\x01\x01" },
+		},
+		{
+			auth: "oauthbearer",
+			initial: func(host, port string) string {
+				return "n,a=me@example.com,\x01host=" + host + "\x01port=" + port + "\x01auth=Bearer tok\x01\x01"
+			},
+		},
+		{
+			auth:     "xoauth2",
+			reject:   failure,
+			initial:  func(string, string) string { return "user=me@example.com\x01auth=Bearer tok\x01\x01" },
+			response: "",
+		},
+		{
+			auth:   "oauthbearer",
+			reject: failure,
+			initial: func(host, port string) string {
+				return "n,a=me@example.com,\x01host=" + host + "\x01port=" + port + "\x01auth=Bearer tok\x01\x01"
+			},
+			response: "\x01",
+		},
+	}
+
+	for _, tt := range tests {
+		name := tt.auth
+		if tt.reject != "" {
+			name += " rejected"
+		}
+		t.Run(name, func(t *testing.T) {
+			addr, exchanges := fakeSASLServer(t, tt.reject)
+			host, port, _ := net.SplitHostPort(addr)
+			c, err := client.Dial(addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.ErrorLog = log.New(io.Discard, "", 0)
+			defer c.Terminate()
+
+			config := &Config{IMAP: IMAPConfig{Server: addr, Username: "me@example.com", Auth: tt.auth}}
+			err = imapAuthenticate(c, config, tokens)
+			e := <-exchanges
+
+			if e.mech != strings.ToUpper(tt.auth) {
+				t.Errorf("mechanism = %q, want %q", e.mech, strings.ToUpper(tt.auth))
+			}
+			if want := tt.initial(host, port); e.initial != want {
+				t.Errorf("initial response = %q, want %q", e.initial, want)
+			}
+			if tt.reject == "" {
+				if err != nil {
+					t.Errorf("imapAuthenticate: %v", err)
+				}
+				return
+			}
+			if e.response != tt.response {
+				t.Errorf("response to the error challenge = %q, want %q", e.response, tt.response)
+			}
+			if err == nil || !strings.Contains(err.Error(), `(401, scope "https://mail.google.com/")`) {
+				t.Errorf("error = %v, want one with the server's reason", err)
+			}
+		})
+	}
+}
+
+func TestIMAPAddress(t *testing.T) {
+	tests := []struct {
+		server, security string
+		host, port       string
+	}{
+		{"imap.example.com:1993", "", "imap.example.com", "1993"},
+		{"imap.example.com", "", "imap.example.com", "993"},
+		{"imap.example.com", "tls", "imap.example.com", "993"},
+		{"imap.example.com", "STARTTLS", "imap.example.com", "143"},
+		{"imap.example.com", "plaintext", "imap.example.com", "143"},
+		{"[::1]:143", "", "::1", "143"},
+	}
+	for _, tt := range tests {
+		host, port := imapAddress(IMAPConfig{Server: tt.server, Security: tt.security})
+		if host != tt.host || port != tt.port {
+			t.Errorf("imapAddress(%q, %q) = %q, %q; want %q, %q", tt.server, tt.security, host, port, tt.host, tt.port)
+		}
+	}
+}
@@ -0,0 +1,324 @@
+package api
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"golang.org/x/oauth2"
+)
+
+const (
+	defaultIMAPTimeout = 30 * time.Second
+	// keepaliveInterval is how often an idle connection is sent a NOOP, well
+	// within the 30 minutes servers must wait before dropping one.
+	keepaliveInterval = 4 * time.Minute
+	minBackoff        = time.Second
+	maxBackoff        = time.Minute
+)
+
+// ConnState is the state of the connection to an IMAP server.
+type ConnState int
+
+const (
+	Connected ConnState = iota
+	// Disconnected means the connection was lost and will be tried again
+	// after a while.
+	Disconnected
+	Reconnecting
+)
+
+// ConnStatus is the state of the connection, why it was lost and how long
+// it is until the next attempt to restore it.
+type ConnStatus struct {
+	State ConnState
+	Err   error
+	Retry time.Duration
+}
+
+// ErrIMAPDisconnected is returned by commands while the connection to the
+// server is being restored.
+var ErrIMAPDisconnected = errors.New("not connected to the IMAP server")
+
+// connectIMAP connects to the server of the config's IMAP account and logs
+// in.
+func connectIMAP(config *Config, tokens oauth2.TokenSource) (*client.Client, error) {
+	c, err := dialIMAP(config.IMAP)
+	if err != nil {
+		return nil, err
+	}
+	stop := watchdog(c, imapTimeout(config.IMAP))
+	defer stop()
+	if err := imapAuthenticate(c, config, tokens); err != nil {
+		c.Terminate()
+		return nil, fmt.Errorf("logging in to %s: %w", config.IMAP.Server, err)
+	}
+	return c, nil
+}
+
+// OnStatusChange calls f, from a goroutine of its own, whenever the state
+// of the connection changes.
+func (e *IMAP) OnStatusChange(f func(ConnStatus)) {
+	e.statusMu.Lock()
+	defer e.statusMu.Unlock()
+	e.onStatus = f
+}
+
+// Status returns the state of the connection.
+func (e *IMAP) Status() ConnStatus {
+	e.statusMu.Lock()
+	defer e.statusMu.Unlock()
+	return e.status
+}
+
+func (e *IMAP) setStatus(status ConnStatus) {
+	e.statusMu.Lock()
+	e.status = status
+	f := e.onStatus
+	e.statusMu.Unlock()
+	if f != nil {
+		f(status)
+	}
+}
+
+// connected fails while the connection is down, which the maintainer is then
+// already restoring. Otherwise it starts the watchdog of the request about
+// to be made, which unlock stops. It is called with mu held.
+func (e *IMAP) connected() error {
+	if e.conn.State() == imap.LogoutState {
+		return ErrIMAPDisconnected
+	}
+	c := e.conn
+	e.watch = time.AfterFunc(e.timeout, func() { c.Terminate() })
+	return nil
+}
+
+// unlock ends a request started with connected.
+func (e *IMAP) unlock() {
+	if e.watch != nil {
+		e.watch.Stop()
+		e.watch = nil
+	}
+	e.mu.Unlock()
+}
+
+// maintain keeps the connection alive with NOOPs and restores it when it is
+// lost, until Close is called.
+func (e *IMAP) maintain() {
+	keepalive := time.NewTicker(keepaliveInterval)
+	defer keepalive.Stop()
+	for {
+		e.mu.Lock()
+		loggedOut := e.conn.LoggedOut()
+		e.mu.Unlock()
+
+		select {
+		case <-e.done:
+			return
+		case <-loggedOut:
+			e.reconnect()
+		case <-keepalive.C:
+			e.mu.Lock()
+			if e.connected() == nil {
+				e.conn.Noop()
+			}
+			e.unlock()
+		}
+	}
+}
+
+// reconnect connects again, waiting twice as long after each failed attempt,
+// and selects the mailbox that was selected.
+func (e *IMAP) reconnect() {
+	var lastErr error
+	for backoff := minBackoff; ; backoff = min(2*backoff, maxBackoff) {
+		e.setStatus(ConnStatus{State: Disconnected, Err: lastErr, Retry: backoff})
+		select {
+		case <-e.done:
+			return
+		case <-time.After(backoff):
+		}
+
+		e.setStatus(ConnStatus{State: Reconnecting, Err: lastErr})
+		c, err := connectIMAP(e.config, e.tokens)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		e.mu.Lock()
+		e.conn = c
+		if e.mailbox != "" {
+			if _, err := c.Select(e.mailbox, false); err != nil {
+				// gone while we were away; the next fetch selects INBOX
+				e.mailbox = ""
+			}
+		}
+		e.mu.Unlock()
+		e.setStatus(ConnStatus{State: Connected})
+		return
+	}
+}
+
+// imapAddress returns the host and port of the server of an IMAP account. The
+// port defaults to 993, or 143 for STARTTLS and plaintext.
+func imapAddress(account IMAPConfig) (host, port string) {
+	host, port, err := net.SplitHostPort(account.Server)
+	if err == nil {
+		return host, port
+	}
+	// no port given
+	switch strings.ToLower(account.Security) {
+	case "starttls", "plaintext":
+		return account.Server, "143"
+	}
+	return account.Server, "993"
+}
+
+// dialIMAP connects to the server of an IMAP account with the security it is
+// set up for: TLS from the start, the default, STARTTLS, or none at all if
+// the account explicitly asks for plaintext.
+func dialIMAP(account IMAPConfig) (*client.Client, error) {
+	security := strings.ToLower(account.Security)
+	host, port := imapAddress(account)
+	addr := net.JoinHostPort(host, port)
+
+	timeout := imapTimeout(account)
+	dialer := &net.Dialer{Timeout: timeout}
+
+	tlsConfig, err := imapTLSConfig(account, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var c *client.Client
+	switch security {
+	case "", "tls":
+		c, err = client.DialWithDialerTLS(dialer, addr, tlsConfig)
+		if err != nil {
+			return nil, explainCertError(host, err)
+		}
+	case "starttls":
+		c, err = client.DialWithDialer(dialer, addr)
+		if err != nil {
+			return nil, err
+		}
+		stop := watchdog(c, timeout)
+		defer stop()
+		if ok, err := c.SupportStartTLS(); err != nil || !ok {
+			c.Terminate()
+			if err == nil {
+				err = fmt.Errorf("%s does not offer STARTTLS", host)
+			}
+			return nil, err
+		}
+		if err := c.StartTLS(tlsConfig); err != nil {
+			c.Terminate()
+			return nil, explainCertError(host, err)
+		}
+	case "plaintext":
+		c, err = client.DialWithDialer(dialer, addr)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown IMAP security %q; use tls, starttls or plaintext", account.Security)
+	}
+	return c, nil
+}
+
+func imapTimeout(account IMAPConfig) time.Duration {
+	if account.Timeout > 0 {
+		return time.Duration(account.Timeout) * time.Second
+	}
+	return defaultIMAPTimeout
+}
+
+// watchdog closes c if what is being done on it takes longer than timeout.
+// go-imap's own Timeout is not used, since the deadline it sets stays in
+// place after a command and closes the connection once it has been idle
+// that long.
+func watchdog(c *client.Client, timeout time.Duration) (stop func() bool) {
+	return time.AfterFunc(timeout, func() { c.Terminate() }).Stop
+}
+
+// imapTLSConfig trusts the system's CAs and those in the account's CA file,
+// or, if the account pins a certificate, that certificate alone.
+func imapTLSConfig(account IMAPConfig, host string) (*tls.Config, error) {
+	config := &tls.Config{ServerName: host}
+
+	if account.PinnedCert != "" {
+		pin := normalizeFingerprint(account.PinnedCert)
+		// the chain is not checked, so a self-signed certificate will do
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return fmt.Errorf("%s sent no certificate", host)
+			}
+			if got := certFingerprint(rawCerts[0]); normalizeFingerprint(got) != pin {
+				return fmt.Errorf("the certificate of %s is %s, not the pinned %s", host, got, account.PinnedCert)
+			}
+			return nil
+		}
+		return config, nil
+	}
+
+	if account.CAFile != "" {
+		pem, err := os.ReadFile(account.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading ca_file: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("ca_file %s holds no PEM certificates", account.CAFile)
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+// certFingerprint formats the SHA-256 fingerprint of a DER certificate the
+// way pinned_cert takes it.
+func certFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	hexSum := strings.ToUpper(hex.EncodeToString(sum[:]))
+	var pairs []string
+	for i := 0; i < len(hexSum); i += 2 {
+		pairs = append(pairs, hexSum[i:i+2])
+	}
+	return "sha256:" + strings.Join(pairs, ":")
+}
+
+func normalizeFingerprint(fingerprint string) string {
+	fingerprint = strings.ToLower(strings.TrimSpace(fingerprint))
+	fingerprint = strings.TrimPrefix(fingerprint, "sha256:")
+	return strings.ReplaceAll(fingerprint, ":", "")
+}
+
+// explainCertError turns a failed certificate check into an error that says
+// what can be done about it, including the fingerprint to pin the
+// certificate with if it is to be trusted as it is.
+func explainCertError(host string, err error) error {
+	var verifyErr *tls.CertificateVerificationError
+	if !errors.As(err, &verifyErr) {
+		return err
+	}
+	msg := fmt.Sprintf("the certificate of %s could not be verified: %v", host, verifyErr.Err)
+	if certs := verifyErr.UnverifiedCertificates; len(certs) > 0 {
+		msg += fmt.Sprintf(". If the server uses its own CA, set the IMAP ca_file to it; "+
+			"to trust this certificate as it is, set pinned_cert to %q", certFingerprint(certs[0].Raw))
+	}
+	return errors.New(msg)
+}
@@ -0,0 +1,65 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// KeysConfig is the keybindings file, keys.json under MAILTERM_HOME. Preset
+// picks the base bindings ("default" or "vim"); each context then maps
+// action names to the key sequences that trigger them, replacing the
+// preset's keys for that action. An empty list unbinds the action.
+//
+//	{
+//	  "preset": "vim",
+//	  "list": {"delete": ["dd", "<Del>"], "archive": "a"},
+//	  "message": {"back": ["h", "<Esc>"]}
+//	}
+type KeysConfig struct {
+	Preset   string             `json:"preset"`
+	List     map[string]KeyList `json:"list"`
+	Message  map[string]KeyList `json:"message"`
+	Compose  map[string]KeyList `json:"compose"`
+	Settings map[string]KeyList `json:"settings"`
+	Labels   map[string]KeyList `json:"labels"`
+}
+
+// KeyList is one or more key sequences. In the file it may be a single
+// string or a list of strings.
+type KeyList []string
+
+func (k *KeyList) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*k = KeyList{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return fmt.Errorf("keys must be a string or a list of strings")
+	}
+	*k = many
+	return nil
+}
+
+// LoadKeysConfig reads the keybindings file. A missing file gives the
+// default bindings.
+func LoadKeysConfig() (*KeysConfig, error) {
+	path := filepath.Join(os.Getenv("MAILTERM_HOME"), "keys.json")
+	file, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &KeysConfig{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var config KeysConfig
+	if err := json.Unmarshal(file, &config); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	return &config, nil
+}
@@ -0,0 +1,193 @@
+package api
+
+import (
+	"bufio"
+	"mime"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// MailcapEntry is one RFC 1524 mailcap line.
+type MailcapEntry struct {
+	Type          string
+	Command       string
+	Test          string
+	CopiousOutput bool
+	NeedsTerminal bool
+}
+
+// Mailcap holds entries in the order they were read; the first match wins.
+type Mailcap []MailcapEntry
+
+// MailcapPaths returns the files to read, honoring the configured file first
+// and then $MAILCAPS or the standard locations.
+func MailcapPaths(configured string) []string {
+	if configured != "" {
+		return []string{configured}
+	}
+	if env := os.Getenv("MAILCAPS"); env != "" {
+		return filepath.SplitList(env)
+	}
+	return []string{
+		filepath.Join(os.Getenv("HOME"), ".mailcap"),
+		"/etc/mailcap",
+	}
+}
+
+// LoadMailcap reads every existing file in paths. Missing files are skipped.
+func LoadMailcap(paths ...string) (Mailcap, error) {
+	var m Mailcap
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		scanner := bufio.NewScanner(f)
+		var line strings.Builder
+		for scanner.Scan() {
+			text := scanner.Text()
+			if strings.HasSuffix(text, "\\") {
+				line.WriteString(strings.TrimSuffix(text, "\\"))
+				continue
+			}
+			line.WriteString(text)
+			if entry, ok := parseMailcapLine(line.String()); ok {
+				m = append(m, entry)
+			}
+			line.Reset()
+		}
+		err = scanner.Err()
+		_ = f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func parseMailcapLine(line string) (MailcapEntry, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return MailcapEntry{}, false
+	}
+
+	fields := splitMailcapFields(line)
+	if len(fields) < 2 {
+		return MailcapEntry{}, false
+	}
+
+	entry := MailcapEntry{
+		Type:    strings.ToLower(fields[0]),
+		Command: fields[1],
+	}
+	if !strings.Contains(entry.Type, "/") {
+		entry.Type += "/*"
+	}
+	for _, field := range fields[2:] {
+		key, value, _ := strings.Cut(field, "=")
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "copiousoutput":
+			entry.CopiousOutput = true
+		case "needsterminal":
+			entry.NeedsTerminal = true
+		case "test":
+			entry.Test = strings.TrimSpace(value)
+		}
+	}
+	return entry, true
+}
+
+// splitMailcapFields splits on semicolons that are not escaped with a
+// backslash.
+func splitMailcapFields(line string) []string {
+	var fields []string
+	var field strings.Builder
+	escaped := false
+	for _, r := range line {
+		switch {
+		case escaped:
+			if r != ';' {
+				field.WriteRune('\\')
+			}
+			field.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == ';':
+			fields = append(fields, strings.TrimSpace(field.String()))
+			field.Reset()
+		default:
+			field.WriteRune(r)
+		}
+	}
+	return append(fields, strings.TrimSpace(field.String()))
+}
+
+// Lookup returns the first entry matching contentType whose test command, if
+// any, succeeds on file.
+func (m Mailcap) Lookup(contentType, file string) (MailcapEntry, bool) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return MailcapEntry{}, false
+	}
+	major, _, _ := strings.Cut(mediaType, "/")
+	for _, entry := range m {
+		if entry.Type != mediaType && entry.Type != major+"/*" {
+			continue
+		}
+		if entry.Test != "" {
+			test, _ := expandMailcapCommand(entry.Test, file, mediaType)
+			if exec.Command("sh", "-c", test).Run() != nil {
+				continue
+			}
+		}
+		return entry, true
+	}
+	return MailcapEntry{}, false
+}
+
+// Expand substitutes %s with the quoted file name and %t with the quoted
+// type and subtype of contentType. It reports whether the command expects the
+// data on stdin instead.
+func (e MailcapEntry) Expand(file, contentType string) (string, bool) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = "application/octet-stream"
+	}
+	return expandMailcapCommand(e.Command, file, mediaType)
+}
+
+// expandMailcapCommand quotes every substitution, since the file name and
+// the content type come from the message and the command runs in a shell.
+// It substitutes in one pass so that a value cannot bring in another %s.
+func expandMailcapCommand(command, file, mediaType string) (string, bool) {
+	var expanded strings.Builder
+	stdin := true
+	for i := 0; i < len(command); i++ {
+		if command[i] == '%' && i+1 < len(command) {
+			switch command[i+1] {
+			case 's':
+				expanded.WriteString(shellQuote(file))
+				stdin = false
+				i++
+				continue
+			case 't':
+				expanded.WriteString(shellQuote(mediaType))
+				i++
+				continue
+			}
+		}
+		expanded.WriteByte(command[i])
+	}
+	return expanded.String(), stdin
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,103 @@
+package api
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseMailcapLine(t *testing.T) {
+	tests := []struct {
+		line  string
+		want  MailcapEntry
+		valid bool
+	}{
+		{"# comment", MailcapEntry{}, false},
+		{"", MailcapEntry{}, false},
+		{"text/plain", MailcapEntry{}, false},
+		{"text/html; w3m -dump %s; copiousoutput", MailcapEntry{Type: "text/html", Command: "w3m -dump %s", CopiousOutput: true}, true},
+		{"image; feh %s", MailcapEntry{Type: "image/*", Command: "feh %s"}, true},
+		{"Application/PDF; zathura %s; test=test -n \"$DISPLAY\"", MailcapEntry{Type: "application/pdf", Command: "zathura %s", Test: "test -n \"$DISPLAY\""}, true},
+		{"text/x-diff; less %s; needsterminal", MailcapEntry{Type: "text/x-diff", Command: "less %s", NeedsTerminal: true}, true},
+		{`text/plain; sed 's/a\;b/c/' %s`, MailcapEntry{Type: "text/plain", Command: `sed 's/a;b/c/' %s`}, true},
+	}
+	for _, tt := range tests {
+		got, ok := parseMailcapLine(tt.line)
+		if ok != tt.valid || got != tt.want {
+			t.Errorf("parseMailcapLine(%q) = %+v, %v; want %+v, %v", tt.line, got, ok, tt.want, tt.valid)
+		}
+	}
+}
+
+func TestExpandMailcapCommand(t *testing.T) {
+	tests := []struct {
+		command, file, mediaType string
+		want                     string
+		stdin                    bool
+	}{
+		{"less %s", "/tmp/a.txt", "text/plain", "less '/tmp/a.txt'", false},
+		{"cat", "/tmp/a.txt", "text/plain", "cat", true},
+		{"view --type=%t", "/tmp/a", "text/plain", "view --type='text/plain'", true},
+		{"view %s", "/tmp/it's.txt", "text/plain", `view '/tmp/it'\''s.txt'`, false},
+		// a substituted value is not expanded again
+		{"view %t %s", "/tmp/a", "text/%s", "view 'text/%s' '/tmp/a'", false},
+		{"echo 100%", "/tmp/a", "text/plain", "echo 100%", true},
+	}
+	for _, tt := range tests {
+		got, stdin := expandMailcapCommand(tt.command, tt.file, tt.mediaType)
+		if got != tt.want || stdin != tt.stdin {
+			t.Errorf("expandMailcapCommand(%q, %q, %q) = %q, %v; want %q, %v", tt.command, tt.file, tt.mediaType, got, stdin, tt.want, tt.stdin)
+		}
+	}
+}
+
+func TestMailcapExpandContentType(t *testing.T) {
+	e := MailcapEntry{Command: "view --type=%t"}
+	got, _ := e.Expand("/tmp/a", "text/x`id`$(id)|{x}; charset=utf-8")
+	if want := "view --type='application/octet-stream'"; got != want {
+		t.Errorf("Expand with a crafted content type = %q, want %q", got, want)
+	}
+	got, _ = e.Expand("/tmp/a", "Text/HTML; charset=utf-8")
+	if want := "view --type='text/html'"; got != want {
+		t.Errorf("Expand = %q, want %q", got, want)
+	}
+}
+
+func TestLoadMailcapLookup(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "mailcap")
+	err := os.WriteFile(path, []byte(`# viewers
+text/html; w3m -dump %s; \
+	copiousoutput
+image/png; never %s; test=false
+image/*; feh %s
+text/plain; less %s; test=test -f %s
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := LoadMailcap(filepath.Join(dir, "missing"), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		contentType, file string
+		command           string
+		found             bool
+	}{
+		{"text/html; charset=utf-8", "", "w3m -dump %s", true},
+		{"IMAGE/PNG", "", "feh %s", true},
+		{"image/jpeg", "", "feh %s", true},
+		{"text/plain", path, "less %s", true},
+		{"text/plain", filepath.Join(dir, "missing"), "", false},
+		{"application/pdf", "", "", false},
+		{"not a type", "", "", false},
+	}
+	for _, tt := range tests {
+		entry, ok := m.Lookup(tt.contentType, tt.file)
+		if ok != tt.found || entry.Command != tt.command {
+			t.Errorf("Lookup(%q, %q) = %q, %v; want %q, %v", tt.contentType, tt.file, entry.Command, ok, tt.command, tt.found)
+		}
+	}
+}
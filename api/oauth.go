@@ -0,0 +1,233 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const defaultAuthTimeout = 5 * time.Minute
+
+// OAuthConfig sets up signing in through the browser.
+type OAuthConfig struct {
+	// Port is the loopback port the browser is sent back to; 0 picks a free
+	// one. Set it if the app registration only allows a fixed redirect URI.
+	Port int `json:"port,omitempty"`
+	// Timeout is how many seconds to wait for the sign-in. 0 means 5
+	// minutes.
+	Timeout int `json:"timeout,omitempty"`
+}
+
+var oauthSettings OAuthConfig
+
+// ShowAuthURL shows the address to sign in at while authorization waits for
+// the browser; cancel gives up on it. It returns a function that takes the
+// address away again. The interface sets it; by default the address is
+// printed.
+var ShowAuthURL func(url string, cancel func()) (done func())
+
+// authorize gets a token through the authorization code flow with PKCE. The
+// user signs in at the address ShowAuthURL shows, and the browser brings the
+// code back to a server on the loopback interface.
+func authorize(config *oauth2.Config) (*oauth2.Token, error) {
+	timeout := defaultAuthTimeout
+	if oauthSettings.Timeout > 0 {
+		timeout = time.Duration(oauthSettings.Timeout) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", oauthSettings.Port))
+	if err != nil {
+		return nil, fmt.Errorf("listening for the sign-in redirect: %w", err)
+	}
+	redirected := *config
+	redirected.RedirectURL = fmt.Sprintf("http://127.0.0.1:%d/callback", listener.Addr().(*net.TCPAddr).Port)
+
+	state, err := randomState()
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	codes := make(chan string, 1)
+	failures := make(chan error, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/callback", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		// requests that did not come from this sign-in are turned away
+		if query.Get("state") != state {
+			http.Error(w, "This sign-in link has expired. Start again from MailTerm.", http.StatusBadRequest)
+			return
+		}
+		if reason := query.Get("error"); reason != "" {
+			fmt.Fprintln(w, "Sign-in failed. You can close this window.")
+			select {
+			case failures <- fmt.Errorf("sign-in failed: %s %s", reason, query.Get("error_description")):
+			default:
+			}
+			return
+		}
+		fmt.Fprintln(w, "Signed in. You can close this window and return to MailTerm.")
+		select {
+		case codes <- query.Get("code"):
+		default:
+		}
+	})
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go server.Serve(listener)
+	defer server.Close()
+
+	show := ShowAuthURL
+	if show == nil {
+		show = printAuthURL
+	}
+	done := show(redirected.AuthCodeURL(state, oauth2.AccessTypeOffline, oauth2.S256ChallengeOption(verifier)), cancel)
+	defer done()
+
+	var code string
+	select {
+	case code = <-codes:
+	case err := <-failures:
+		return nil, err
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, fmt.Errorf("gave up waiting for the sign-in after %s", timeout)
+		}
+		return nil, errors.New("sign-in cancelled")
+	}
+
+	token, err := redirected.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return nil, fmt.Errorf("exchanging the authorization code: %w", err)
+	}
+	return token, nil
+}
+
+func randomState() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func printAuthURL(url string, cancel func()) func() {
+	fmt.Fprintf(os.Stderr, "Sign in at the following address in your browser:\n%s\n\n", url)
+	return func() {}
+}
+
+// ErrReauthRequired is returned for the tokens of an account whose refresh
+// token the provider no longer accepts, because it was revoked or has
+// expired. Only signing in again helps.
+var ErrReauthRequired = errors.New("re-authentication required")
+
+// ReauthRequired is told each time a request of an account fails because
+// its sign-in stopped working. signIn signs in again through the browser;
+// until then the account's requests fail with ErrReauthRequired. The
+// interface sets it.
+var ReauthRequired func(account string, signIn func() error)
+
+// oauthTokenSource returns the tokens of an account, starting from the one
+// stored under key. If there is none, or the provider no longer accepts it,
+// the user signs in through the browser first.
+func oauthTokenSource(account, key string, config *oauth2.Config) (*savingTokenSource, error) {
+	s := &savingTokenSource{account: account, key: key, config: config}
+	if token, err := loadOAuthToken(key); err == nil {
+		s.reset(token)
+		// an expired token is refreshed here, which also finds out whether
+		// the refresh token still works; other errors, such as being
+		// offline, are left for the requests to report
+		if _, _, err := s.token(); !errors.Is(err, ErrReauthRequired) {
+			return s, nil
+		}
+	}
+	if err := s.signIn(); err != nil {
+		return nil, fmt.Errorf("signing in to %s: %w", account, err)
+	}
+	return s, nil
+}
+
+// savingTokenSource hands out the tokens of an account, refreshing them as
+// they expire, and stores every new one so that the refreshed token, and
+// the new refresh token of providers that rotate them, outlive the session.
+type savingTokenSource struct {
+	account string
+	key     string
+	config  *oauth2.Config
+
+	mu      sync.Mutex
+	source  oauth2.TokenSource
+	last    *oauth2.Token
+	revoked bool
+}
+
+func (s *savingTokenSource) Token() (*oauth2.Token, error) {
+	token, revoked, err := s.token()
+	if revoked && ReauthRequired != nil {
+		ReauthRequired(s.account, s.signIn)
+	}
+	return token, err
+}
+
+// token gets a token and stores it if it is a new one. revoked reports
+// whether it failed because the refresh token is rejected.
+func (s *savingTokenSource) token() (token *oauth2.Token, revoked bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.revoked {
+		return nil, true, fmt.Errorf("%s: %w", s.account, ErrReauthRequired)
+	}
+
+	token, err = s.source.Token()
+	var retrieveErr *oauth2.RetrieveError
+	if errors.As(err, &retrieveErr) && retrieveErr.ErrorCode == "invalid_grant" {
+		s.revoked = true
+		return nil, true, fmt.Errorf("%s: %w", s.account, ErrReauthRequired)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	// the source hands out the same token until it refreshes it
+	if token != s.last {
+		s.last = token
+		if err := saveOAuthToken(s.key, token); err != nil {
+			log.Printf("Unable to store %s token: %v", s.account, err)
+		}
+	}
+	return token, false, nil
+}
+
+// signIn replaces the token of the account with one got by signing in
+// through the browser.
+func (s *savingTokenSource) signIn() error {
+	token, err := authorize(s.config)
+	if err != nil {
+		return err
+	}
+	if err := saveOAuthToken(s.key, token); err != nil {
+		log.Printf("Unable to store %s token: %v", s.account, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reset(token)
+	return nil
+}
+
+func (s *savingTokenSource) reset(token *oauth2.Token) {
+	s.source = s.config.TokenSource(context.Background(), token)
+	s.last = token
+	s.revoked = false
+}
@@ -0,0 +1,157 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ScheduledMessage is a message waiting in the outbox to be sent at SendAt
+// through Service.
+type ScheduledMessage struct {
+	Id        string    `json:"id"`
+	Service   string    `json:"service"`
+	SendAt    time.Time `json:"send_at"`
+	Message   Message   `json:"message"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// Outbox holds scheduled messages. It is kept in outbox.json under
+// MAILTERM_HOME so that messages are still sent after a restart.
+type Outbox struct {
+	path string
+
+	mu       sync.Mutex
+	messages []ScheduledMessage
+	sending  map[string]bool // claimed by Claim
+}
+
+// LoadOutbox reads the outbox. A missing file is an empty outbox.
+func LoadOutbox() (*Outbox, error) {
+	o := &Outbox{
+		path:    filepath.Join(os.Getenv("MAILTERM_HOME"), "outbox.json"),
+		sending: make(map[string]bool),
+	}
+
+	file, err := os.ReadFile(o.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return o, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(file, &o.messages); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", o.path, err)
+	}
+	return o, nil
+}
+
+// Messages returns the scheduled messages, soonest first.
+func (o *Outbox) Messages() []ScheduledMessage {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]ScheduledMessage(nil), o.messages...)
+}
+
+// Due returns the messages whose time has come and that are not being sent.
+func (o *Outbox) Due(now time.Time) []ScheduledMessage {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var due []ScheduledMessage
+	for _, m := range o.messages {
+		if !m.SendAt.After(now) && !o.sending[m.Id] {
+			due = append(due, m)
+		}
+	}
+	return due
+}
+
+// Schedule adds a message to the outbox and returns its entry.
+func (o *Outbox) Schedule(service string, message Message, sendAt time.Time) (ScheduledMessage, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return ScheduledMessage{}, err
+	}
+	m := ScheduledMessage{
+		Id:      hex.EncodeToString(id),
+		Service: service,
+		SendAt:  sendAt,
+		Message: message,
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.messages = append(o.messages, m)
+	sort.SliceStable(o.messages, func(i, j int) bool {
+		return o.messages[i].SendAt.Before(o.messages[j].SendAt)
+	})
+	return m, o.save()
+}
+
+// Claim marks a message as being sent, so that it can be neither recalled
+// nor cancelled until Done. It reports false if the message has been taken
+// out of the outbox or is already being sent.
+func (o *Outbox) Claim(id string) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.sending[id] || o.index(id) < 0 {
+		return false
+	}
+	o.sending[id] = true
+	return true
+}
+
+// Done ends the sending of a claimed message. A sent one is taken out of the
+// outbox; one that failed stays in it with the error and is tried again
+// later.
+func (o *Outbox) Done(id string, sendErr error) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	delete(o.sending, id)
+	i := o.index(id)
+	if i < 0 {
+		return nil
+	}
+	if sendErr != nil {
+		o.messages[i].LastError = sendErr.Error()
+	} else {
+		o.messages = slices.Delete(o.messages, i, i+1)
+	}
+	return o.save()
+}
+
+// Remove takes a message out of the outbox to recall or cancel it. It
+// reports false if the message is no longer there or is being sent.
+func (o *Outbox) Remove(id string) (bool, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	i := o.index(id)
+	if i < 0 || o.sending[id] {
+		return false, nil
+	}
+	o.messages = slices.Delete(o.messages, i, i+1)
+	return true, o.save()
+}
+
+// index returns where the message with the given id is, or -1. The caller
+// holds o.mu.
+func (o *Outbox) index(id string) int {
+	return slices.IndexFunc(o.messages, func(m ScheduledMessage) bool { return m.Id == id })
+}
+
+// save writes the outbox. The caller holds o.mu.
+func (o *Outbox) save() error {
+	file, err := json.MarshalIndent(o.messages, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(o.path, file, 0600)
+}
@@ -0,0 +1,403 @@
+package api
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// SecretsConfig chooses where passwords and tokens are kept.
+type SecretsConfig struct {
+	// Store is "secret-service" for the desktop keyring (through
+	// secret-tool), "vault" for a file encrypted with a passphrase, or
+	// "file" to keep them in plain text in config.json and token files. The
+	// default uses the keyring if there is one and plain text otherwise.
+	Store string `json:"store"`
+}
+
+// SecretStore keeps secrets by key.
+type SecretStore interface {
+	// Get returns ErrSecretNotFound if there is no secret under key.
+	Get(key string) (string, error)
+	Set(key, value string) error
+	Delete(key string) error
+}
+
+var ErrSecretNotFound = errors.New("secret not found")
+
+// The keys secrets are stored under.
+const (
+	secretGmailToken = "gmail-token"
+	secretIMAP       = "imap-password"
+	secretIMAPToken  = "imap-token"
+)
+
+// tokenFiles are the files under MAILTERM_HOME OAuth tokens are kept in if
+// secrets are stored in plain text, by secret key.
+var tokenFiles = map[string]string{
+	secretGmailToken: "gmail.json",
+	secretIMAPToken:  "imap_token.json",
+}
+
+// VaultPassphrase asks the user for the passphrase of the vault. create is
+// set when the vault does not exist yet and the passphrase is a new one.
+// The interface sets it; without it the vault cannot be opened.
+var VaultPassphrase func(create bool) (string, error)
+
+var (
+	secretsMu     sync.Mutex
+	secretsConfig SecretsConfig
+	openStore     SecretStore
+	openStoreName string
+
+	// vaultMu is held while the vault is opened, so that the passphrase is
+	// asked for once however many callers want it. secretsMu is not held
+	// meanwhile.
+	vaultMu sync.Mutex
+)
+
+// secrets returns the store of the loaded config, opening it on first use,
+// or nil if secrets are kept in plain text.
+func secrets() (SecretStore, error) {
+	secretsMu.Lock()
+	name := secretsConfig.Store
+	if name == "" {
+		name = "file"
+		if secretServiceAvailable() {
+			name = "secret-service"
+		}
+	}
+	if openStore != nil && openStoreName == name {
+		defer secretsMu.Unlock()
+		return openStore, nil
+	}
+	if name == "vault" {
+		secretsMu.Unlock()
+		return secretVault()
+	}
+	defer secretsMu.Unlock()
+
+	switch name {
+	case "file":
+		return nil, nil
+	case "secret-service":
+		if _, err := exec.LookPath("secret-tool"); err != nil {
+			return nil, fmt.Errorf("secret store: secret-tool is not installed")
+		}
+		openStore = secretService{}
+	default:
+		return nil, fmt.Errorf("secret store: unknown store %q; use secret-service, vault or file", name)
+	}
+	openStoreName = name
+	return openStore, nil
+}
+
+// secretVault opens the vault, asking for its passphrase, unless another
+// caller has opened it while this one waited.
+func secretVault() (SecretStore, error) {
+	vaultMu.Lock()
+	defer vaultMu.Unlock()
+
+	secretsMu.Lock()
+	if openStore != nil && openStoreName == "vault" {
+		defer secretsMu.Unlock()
+		return openStore, nil
+	}
+	secretsMu.Unlock()
+
+	v, err := openVault(filepath.Join(os.Getenv("MAILTERM_HOME"), "secrets.vault"))
+	if err != nil {
+		return nil, err
+	}
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	openStore = v
+	openStoreName = "vault"
+	return v, nil
+}
+
+func secretServiceAvailable() bool {
+	_, err := exec.LookPath("secret-tool")
+	return err == nil && os.Getenv("DBUS_SESSION_BUS_ADDRESS") != ""
+}
+
+// migrateSecrets moves the secrets config and the token files hold in plain
+// text into the secret store, if one is used, and clears them from
+// config. It reports whether config changed.
+func migrateSecrets(config *Config) (bool, error) {
+	store, err := secrets()
+	if err != nil || store == nil {
+		return false, err
+	}
+
+	changed := false
+	if config.IMAP.Password != "" {
+		if err := store.Set(secretIMAP, config.IMAP.Password); err != nil {
+			return false, fmt.Errorf("storing IMAP password: %w", err)
+		}
+		config.IMAP.Password = ""
+		changed = true
+	}
+
+	for key, name := range tokenFiles {
+		tokenFile := filepath.Join(os.Getenv("MAILTERM_HOME"), name)
+		token, err := os.ReadFile(tokenFile)
+		if err != nil {
+			continue
+		}
+		if err := store.Set(key, string(token)); err != nil {
+			return changed, fmt.Errorf("storing %s: %w", name, err)
+		}
+		if err := os.Remove(tokenFile); err != nil {
+			return changed, err
+		}
+	}
+	return changed, nil
+}
+
+// IMAPPassword returns the IMAP password: the output of password_cmd if it
+// is set, otherwise the one in the secret store or the config.
+func (c *Config) IMAPPassword() (string, error) {
+	if c.IMAP.PasswordCmd != "" {
+		return runPasswordCommand(c.IMAP.PasswordCmd)
+	}
+	if c.IMAP.Password != "" {
+		return c.IMAP.Password, nil
+	}
+	store, err := secrets()
+	if err != nil || store == nil {
+		return "", err
+	}
+	password, err := store.Get(secretIMAP)
+	if errors.Is(err, ErrSecretNotFound) {
+		return "", nil
+	}
+	return password, err
+}
+
+// runPasswordCommand runs a command such as "pass show mail/work" and
+// returns the first line it prints.
+func runPasswordCommand(command string) (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("running password_cmd %q: %w: %s", command, err, strings.TrimSpace(stderr.String()))
+	}
+	password, _, _ := strings.Cut(string(out), "\n")
+	return strings.TrimSuffix(password, "\r"), nil
+}
+
+// secretService keeps secrets in the freedesktop Secret Service, such as
+// GNOME Keyring or KWallet, through libsecret's secret-tool.
+type secretService struct{}
+
+func (secretService) attributes(key string) []string {
+	return []string{"service", "mailterm", "key", key}
+}
+
+func (s secretService) Get(key string) (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("secret-tool", append([]string{"lookup"}, s.attributes(key)...)...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 && len(out) == 0 && stderr.Len() == 0 {
+		// secret-tool exits with 1 and prints nothing if there is no match;
+		// a locked keyring or a missing service says why on stderr
+		return "", ErrSecretNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("secret-tool lookup: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
+
+func (s secretService) Set(key, value string) error {
+	args := append([]string{"store", "--label", "MailTerm " + key}, s.attributes(key)...)
+	cmd := exec.Command("secret-tool", args...)
+	cmd.Stdin = strings.NewReader(value)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("secret-tool store: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (s secretService) Delete(key string) error {
+	if out, err := exec.Command("secret-tool", append([]string{"clear"}, s.attributes(key)...)...).CombinedOutput(); err != nil {
+		return fmt.Errorf("secret-tool clear: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// vault keeps secrets in a file encrypted with AES-256-GCM under a key
+// derived from a passphrase with scrypt.
+type vault struct {
+	path string
+	key  []byte
+
+	// mu guards the secrets and the file, which the token sources of
+	// several accounts can update at once.
+	mu      sync.Mutex
+	file    vaultFile
+	secrets map[string]string
+}
+
+// vaultFile is the vault as stored. Data is the secrets as JSON, sealed with
+// Nonce; the scrypt parameters are kept so that they can be raised later.
+type vaultFile struct {
+	N     int    `json:"n"`
+	R     int    `json:"r"`
+	P     int    `json:"p"`
+	Salt  []byte `json:"salt"`
+	Nonce []byte `json:"nonce"`
+	Data  []byte `json:"data"`
+}
+
+func openVault(path string) (*vault, error) {
+	if VaultPassphrase == nil {
+		return nil, errors.New("vault: no way to ask for the passphrase")
+	}
+	v := &vault{path: path, secrets: make(map[string]string)}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		passphrase, err := VaultPassphrase(true)
+		if err != nil {
+			return nil, err
+		}
+		v.file = vaultFile{N: 1 << 15, R: 8, P: 1, Salt: make([]byte, 16)}
+		if _, err := rand.Read(v.file.Salt); err != nil {
+			return nil, err
+		}
+		if v.key, err = v.deriveKey(passphrase); err != nil {
+			return nil, err
+		}
+		return v, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &v.file); err != nil {
+		return nil, fmt.Errorf("vault %s: %w", path, err)
+	}
+	passphrase, err := VaultPassphrase(false)
+	if err != nil {
+		return nil, err
+	}
+	if v.key, err = v.deriveKey(passphrase); err != nil {
+		return nil, err
+	}
+	gcm, err := v.cipher()
+	if err != nil {
+		return nil, err
+	}
+	plain, err := gcm.Open(nil, v.file.Nonce, v.file.Data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("vault %s: wrong passphrase or damaged file", path)
+	}
+	if err := json.Unmarshal(plain, &v.secrets); err != nil {
+		return nil, fmt.Errorf("vault %s: %w", path, err)
+	}
+	return v, nil
+}
+
+func (v *vault) deriveKey(passphrase string) ([]byte, error) {
+	return scrypt.Key([]byte(passphrase), v.file.Salt, v.file.N, v.file.R, v.file.P, 32)
+}
+
+func (v *vault) cipher() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(v.key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (v *vault) Get(key string) (string, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	value, ok := v.secrets[key]
+	if !ok {
+		return "", ErrSecretNotFound
+	}
+	return value, nil
+}
+
+func (v *vault) Set(key, value string) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.secrets[key] = value
+	return v.save()
+}
+
+func (v *vault) Delete(key string) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	delete(v.secrets, key)
+	return v.save()
+}
+
+// save seals the secrets under a fresh nonce and replaces the file. The
+// caller holds v.mu.
+func (v *vault) save() error {
+	plain, err := json.Marshal(v.secrets)
+	if err != nil {
+		return err
+	}
+	gcm, err := v.cipher()
+	if err != nil {
+		return err
+	}
+	v.file.Nonce = make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(v.file.Nonce); err != nil {
+		return err
+	}
+	v.file.Data = gcm.Seal(nil, v.file.Nonce, plain, nil)
+
+	data, err := json.MarshalIndent(v.file, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(v.path, data, 0600)
+}
+
+// writeFileAtomic writes a file through a temporary one in the same
+// directory, so that a crash leaves either the old contents or the new.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,80 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ThemeConfig is a color theme. Colors are names such as "navy" or
+// "lightgray", "#rrggbb", or "default" for the terminal's own color. Fields
+// left empty are taken from the theme named in Base.
+type ThemeConfig struct {
+	Name string `json:"name"`
+	Base string `json:"base"`
+
+	Background string `json:"background"`
+	Text       string `json:"text"`
+	Secondary  string `json:"secondary"`
+	Label      string `json:"label"`
+	Border     string `json:"border"`
+	Title      string `json:"title"`
+
+	Header     string `json:"header"`
+	HeaderText string `json:"header_text"`
+	StatusBar  string `json:"status_bar"`
+	StatusText string `json:"status_text"`
+
+	Unread       string `json:"unread"`
+	Read         string `json:"read"`
+	Tagged       string `json:"tagged"`
+	Selected     string `json:"selected"`
+	SelectedText string `json:"selected_text"`
+
+	Input      string `json:"input"`
+	InputText  string `json:"input_text"`
+	Button     string `json:"button"`
+	ButtonText string `json:"button_text"`
+
+	Heading       string   `json:"heading"`
+	MessageHeader string   `json:"message_header"`
+	Quote         []string `json:"quote"` // one color per quoting level, repeating
+	Error         string   `json:"error"`
+}
+
+// LoadThemes reads the user themes, one per .json file in the themes
+// directory under MAILTERM_HOME, sorted by name. A theme without a name is
+// named after its file.
+func LoadThemes() ([]ThemeConfig, error) {
+	dir := filepath.Join(os.Getenv("MAILTERM_HOME"), "themes")
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var themes []ThemeConfig
+	var problems []error
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			problems = append(problems, err)
+			continue
+		}
+		var theme ThemeConfig
+		if err := json.Unmarshal(data, &theme); err != nil {
+			problems = append(problems, fmt.Errorf("reading %s: %w", file, err))
+			continue
+		}
+		if theme.Name == "" {
+			theme.Name = strings.TrimSuffix(filepath.Base(file), ".json")
+		}
+		themes = append(themes, theme)
+	}
+
+	sort.Slice(themes, func(i, j int) bool { return themes[i].Name < themes[j].Name })
+	return themes, errors.Join(problems...)
+}
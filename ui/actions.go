@@ -0,0 +1,465 @@
+package ui
+
+import (
+	"cartsu/mailterm/api"
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+)
+
+const defaultMarkReadDelay = 3 * time.Second
+
+// readTimer marks the open message read under the "delay" policy. It is
+// stopped when another message is opened first.
+var readTimer *time.Timer
+
+func messageUid(message api.MessageSummary) (uint32, error) {
+	uid, err := strconv.ParseUint(message.Id, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid IMAP uid %q", message.Id)
+	}
+	return uint32(uid), nil
+}
+
+func messageUids(messages []api.MessageSummary) ([]uint32, error) {
+	uids := make([]uint32, len(messages))
+	for i, message := range messages {
+		uid, err := messageUid(message)
+		if err != nil {
+			return nil, err
+		}
+		uids[i] = uid
+	}
+	return uids, nil
+}
+
+func messageIds(messages []api.MessageSummary) []string {
+	ids := make([]string, len(messages))
+	for i, message := range messages {
+		ids[i] = message.Id
+	}
+	return ids
+}
+
+func threadIds(messages []api.MessageSummary) []string {
+	ids := make([]string, len(messages))
+	for i, message := range messages {
+		ids[i] = message.ThreadId
+	}
+	return ids
+}
+
+// deleteMessages moves messages to the trash of a service. It returns a
+// function that takes them out again, or nil if the service cannot.
+func deleteMessages(service string, messages []api.MessageSummary) (func() error, error) {
+	switch service {
+	case "gmail":
+		ids := threadIds(messages)
+		if err := ui.Client.GmailClient.TrashThreads(ids...); err != nil {
+			return nil, err
+		}
+		return func() error { return ui.Client.GmailClient.UntrashThreads(ids...) }, nil
+	case "graph":
+		newIds, err := ui.Client.GraphClient.DeleteMessages(messageIds(messages)...)
+		if err != nil {
+			return nil, err
+		}
+		return returnToInbox(messages, newIds), nil
+	case "imap":
+		uids, err := messageUids(messages)
+		if err != nil {
+			return nil, err
+		}
+		// the trashed copies get new uids that go-imap does not report
+		return nil, ui.Client.IMAP.DeleteMessage(uids...)
+	}
+	return nil, fmt.Errorf("deleting is not supported for %s", service)
+}
+
+// setRead marks messages, or threads on Gmail, read or unread.
+func setRead(service string, messages []api.MessageSummary, read bool) error {
+	switch service {
+	case "gmail":
+		return ui.Client.GmailClient.MarkThreadsRead(read, threadIds(messages)...)
+	case "graph":
+		return ui.Client.GraphClient.SetRead(read, messageIds(messages)...)
+	case "imap":
+		uids, err := messageUids(messages)
+		if err != nil {
+			return err
+		}
+		if read {
+			return ui.Client.IMAP.MarkAsRead(uids...)
+		}
+		return ui.Client.IMAP.MarkAsUnread(uids...)
+	}
+	return fmt.Errorf("unknown service %q", service)
+}
+
+// toggleRead marks the target messages read if any of them is unread, and
+// unread otherwise.
+func toggleRead(emailList *messageTable) {
+	messages := emailList.Targets()
+	if len(messages) == 0 {
+		return
+	}
+	read := slices.ContainsFunc(messages, func(m api.MessageSummary) bool { return m.Unread })
+	service := ui.Client.ActiveService
+	runWrite("Updating messages", func() error {
+		return setRead(service, messages, read)
+	}, func(err error) {
+		if err != nil {
+			showNotice(fmt.Sprintf("Error updating messages: %v", err))
+			return
+		}
+		for _, message := range messages {
+			message.Unread = !read
+			emailList.Update(message)
+		}
+	})
+}
+
+// applyReadPolicy marks a just-opened message read according to the
+// mark_read setting.
+func applyReadPolicy(emailList *messageTable, message api.MessageSummary) {
+	if readTimer != nil {
+		readTimer.Stop()
+		readTimer = nil
+	}
+	if !message.Unread {
+		return
+	}
+
+	service := ui.Client.ActiveService
+	markRead := func() {
+		runWrite("Marking read", func() error {
+			return setRead(service, []api.MessageSummary{message}, true)
+		}, func(err error) {
+			if err != nil {
+				return
+			}
+			message.Unread = false
+			emailList.Update(message)
+		})
+	}
+
+	switch ui.Config.UI.MarkRead {
+	case "never":
+	case "delay":
+		delay := defaultMarkReadDelay
+		if ui.Config.UI.MarkReadDelay > 0 {
+			delay = time.Duration(ui.Config.UI.MarkReadDelay) * time.Second
+		}
+		readTimer = time.AfterFunc(delay, func() {
+			ui.App.QueueUpdateDraw(markRead)
+		})
+	default:
+		markRead()
+	}
+}
+
+// setFlagged stars Gmail threads or flags IMAP or Graph messages.
+func setFlagged(service string, messages []api.MessageSummary, flagged bool) error {
+	switch service {
+	case "gmail":
+		return ui.Client.GmailClient.StarThreads(flagged, threadIds(messages)...)
+	case "graph":
+		return ui.Client.GraphClient.SetFlagged(flagged, messageIds(messages)...)
+	case "imap":
+		uids, err := messageUids(messages)
+		if err != nil {
+			return err
+		}
+		return ui.Client.IMAP.SetFlagged(flagged, uids...)
+	}
+	return fmt.Errorf("unknown service %q", service)
+}
+
+// archiveMessages archives messages and returns a function that puts them
+// back, or nil if the service cannot.
+func archiveMessages(service string, messages []api.MessageSummary) (func() error, error) {
+	switch service {
+	case "gmail":
+		if err := ui.Client.GmailClient.ArchiveThreads(threadIds(messages)...); err != nil {
+			return nil, err
+		}
+		return restoreGmailLabels(messages, nil, []string{"INBOX"}), nil
+	case "graph":
+		newIds, err := ui.Client.GraphClient.ArchiveMessages(messageIds(messages)...)
+		if err != nil {
+			return nil, err
+		}
+		return returnToInbox(messages, newIds), nil
+	case "imap":
+		uids, err := messageUids(messages)
+		if err != nil {
+			return nil, err
+		}
+		return nil, ui.Client.IMAP.ArchiveMessages(uids...)
+	}
+	return nil, fmt.Errorf("unknown service %q", service)
+}
+
+// moveMessages moves messages to a folder and returns a function that moves
+// them back, or nil if the service cannot.
+func moveMessages(service string, messages []api.MessageSummary, folder api.Folder) (func() error, error) {
+	switch service {
+	case "gmail":
+		if err := ui.Client.GmailClient.MoveThreads(folder.Id, threadIds(messages)...); err != nil {
+			return nil, err
+		}
+		return restoreGmailLabels(messages, []string{folder.Id}, api.GmailMoveRemoves(folder.Id)), nil
+	case "graph":
+		newIds, err := ui.Client.GraphClient.MoveMessages(folder.Id, messageIds(messages)...)
+		if err != nil {
+			return nil, err
+		}
+		return returnToInbox(messages, newIds), nil
+	case "imap":
+		uids, err := messageUids(messages)
+		if err != nil {
+			return nil, err
+		}
+		return nil, ui.Client.IMAP.MoveMessages(folder.Id, uids...)
+	}
+	return nil, fmt.Errorf("unknown service %q", service)
+}
+
+// returnToInbox moves Graph messages, known by the ids they got when they
+// were moved, back to the inbox the list shows. The messages get their
+// inbox ids back.
+func returnToInbox(messages []api.MessageSummary, newIds []string) func() error {
+	return func() error {
+		ids, err := ui.Client.GraphClient.MoveMessages("inbox", newIds...)
+		if err != nil {
+			return err
+		}
+		for i := range messages {
+			messages[i].Id = ids[i]
+		}
+		return nil
+	}
+}
+
+func getFolders(service string) ([]api.Folder, error) {
+	switch service {
+	case "gmail":
+		return ui.Client.GmailClient.GetFolders()
+	case "graph":
+		return ui.Client.GraphClient.GetFolderList()
+	case "imap":
+		return ui.Client.IMAP.GetFolders()
+	}
+	return nil, fmt.Errorf("unknown service %q", service)
+}
+
+// toggleFlag flags the target messages if any of them is unflagged, and
+// clears their flags otherwise.
+func toggleFlag(emailList *messageTable) {
+	messages := emailList.Targets()
+	if len(messages) == 0 {
+		return
+	}
+	flagged := slices.ContainsFunc(messages, func(m api.MessageSummary) bool { return !m.Flagged })
+	after := slices.Clone(messages)
+	for i := range after {
+		after[i].Flagged = flagged
+	}
+	verb := "Flagged"
+	if !flagged {
+		verb = "Unflagged"
+	}
+	service := ui.Client.ActiveService
+	updateAction(emailList, messages, after, describe(verb, messages),
+		func() error { return setFlagged(service, messages, flagged) },
+		restoreFlags(service, messages))
+}
+
+// removeMessages drops messages that an action took out of the current view.
+func removeMessages(emailList *messageTable, messages []api.MessageSummary) {
+	for _, message := range messages {
+		emailList.Remove(message.Id)
+	}
+	updateListTitle(emailList)
+}
+
+// deleteSelected trashes the target messages and drops them from the list.
+func deleteSelected(emailList *messageTable) {
+	messages := emailList.Targets()
+	if len(messages) == 0 {
+		return
+	}
+	service := ui.Client.ActiveService
+	removeAction(emailList, messages, describe("Deleted", messages), func() (func() error, error) {
+		return deleteMessages(service, messages)
+	})
+}
+
+// archiveSelected archives the target messages and drops them from the list.
+func archiveSelected(emailList *messageTable) {
+	messages := emailList.Targets()
+	if len(messages) == 0 {
+		return
+	}
+	service := ui.Client.ActiveService
+	removeAction(emailList, messages, describe("Archived", messages), func() (func() error, error) {
+		return archiveMessages(service, messages)
+	})
+}
+
+// moveSelected asks for a folder and moves the target messages there.
+func moveSelected(emailList *messageTable) {
+	messages := emailList.Targets()
+	if len(messages) == 0 {
+		return
+	}
+	showFolderPicker("Move to", func(folder api.Folder) {
+		moveToFolder(emailList, messages, folder)
+	})
+}
+
+// moveToFolderNamed moves the targeted messages to the folder with the given
+// name, ignoring case.
+func moveToFolderNamed(emailList *messageTable, name string) {
+	messages := emailList.Targets()
+	if len(messages) == 0 {
+		return
+	}
+	service := ui.Client.ActiveService
+	runTask("Loading folders", func(ctx context.Context) ([]api.Folder, error) {
+		return getFolders(service)
+	}, func(folders []api.Folder, err error) {
+		if err != nil {
+			showNotice(fmt.Sprintf("Error loading folders: %v", err))
+			return
+		}
+		i := slices.IndexFunc(folders, func(f api.Folder) bool { return strings.EqualFold(f.Name, name) })
+		if i < 0 {
+			showNotice(fmt.Sprintf("There is no folder named %q.", name))
+			return
+		}
+		moveToFolder(emailList, messages, folders[i])
+	})
+}
+
+func moveToFolder(emailList *messageTable, messages []api.MessageSummary, folder api.Folder) {
+	service := ui.Client.ActiveService
+	removeAction(emailList, messages, describe("Moved", messages)+" to "+folder.Name, func() (func() error, error) {
+		return moveMessages(service, messages, folder)
+	})
+}
+
+// toggleTag tags or untags the selected message and moves to the next one.
+func toggleTag(emailList *messageTable) {
+	emailList.ToggleTag()
+	if row, _ := emailList.GetSelection(); row+1 < emailList.GetRowCount() {
+		emailList.Select(row+1, 0)
+	}
+	updateListTitle(emailList)
+}
+
+// tagAll tags every loaded message, or untags them if all are tagged.
+func tagAll(emailList *messageTable) {
+	emailList.TagAll()
+	updateListTitle(emailList)
+}
+
+// clearTags untags every message.
+func clearTags(emailList *messageTable) {
+	emailList.ClearTags()
+	updateListTitle(emailList)
+}
+
+// tagMatching asks for a regular expression and tags the loaded messages
+// whose sender or subject matches it, ignoring case.
+func tagMatching(emailList *messageTable) {
+	showPrompt("Tag messages matching", "", func(text string) {
+		if text == "" {
+			return
+		}
+		pattern, err := regexp.Compile("(?i)" + text)
+		if err != nil {
+			showNotice(fmt.Sprintf("Invalid pattern: %v", err))
+			return
+		}
+		if emailList.TagMatching(pattern) == 0 {
+			showNotice("No loaded messages match.")
+		}
+		updateListTitle(emailList)
+	})
+}
+
+// showFolderPicker lists the folders of the active service, narrowed down by
+// typing in the filter field, and calls done with the chosen one.
+func showFolderPicker(title string, done func(folder api.Folder)) {
+	service := ui.Client.ActiveService
+	runTask("Loading folders", func(ctx context.Context) ([]api.Folder, error) {
+		return getFolders(service)
+	}, func(folders []api.Folder, err error) {
+		if err != nil {
+			showNotice(fmt.Sprintf("Error loading folders: %v", err))
+			return
+		}
+		showFolderList(title, folders, done)
+	})
+}
+
+func showFolderList(title string, folders []api.Folder, done func(folder api.Folder)) {
+
+	list := newList().
+		ShowSecondaryText(false)
+	filter := tview.NewInputField().
+		SetLabel("Filter: ")
+
+	var shown []api.Folder
+	refresh := func(text string) {
+		list.Clear()
+		shown = shown[:0]
+		for _, folder := range folders {
+			if strings.Contains(strings.ToLower(folder.Name), strings.ToLower(text)) {
+				shown = append(shown, folder)
+				list.AddItem(tview.Escape(folder.Name), "", 0, nil)
+			}
+		}
+	}
+	refresh("")
+
+	choose := func() {
+		i := list.GetCurrentItem()
+		hidePopup("folders")
+		if i >= 0 && i < len(shown) {
+			done(shown[i])
+		}
+	}
+
+	filter.SetChangedFunc(refresh)
+	filter.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		switch event.Key() {
+		case tcell.KeyDown, tcell.KeyUp, tcell.KeyPgDn, tcell.KeyPgUp:
+			list.InputHandler()(event, nil)
+			return nil
+		case tcell.KeyEnter:
+			choose()
+			return nil
+		case tcell.KeyEscape:
+			hidePopup("folders")
+			return nil
+		}
+		return event
+	})
+
+	layout := tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(filter, 1, 0, true).
+		AddItem(list, 0, 1, false)
+	layout.SetBorder(true).SetTitle(title)
+
+	showPopup("folders", layout, 50, min(len(folders)+3, 20))
+	ui.App.SetFocus(filter)
+}
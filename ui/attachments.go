@@ -0,0 +1,221 @@
+package ui
+
+import (
+	"bytes"
+	"cartsu/mailterm/api"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/rivo/tview"
+)
+
+var mailcap api.Mailcap
+
+func getAttachments(service, messageId string) ([]api.Attachment, error) {
+	switch service {
+	case "gmail":
+		return ui.Client.GmailClient.GetAttachments(messageId)
+	case "graph":
+		return ui.Client.GraphClient.GetAttachments(messageId)
+	case "imap":
+		uid, err := strconv.Atoi(messageId)
+		if err != nil {
+			return nil, err
+		}
+		return ui.Client.IMAP.GetAttachments(uint32(uid))
+	}
+	return nil, fmt.Errorf("unknown service %q", service)
+}
+
+// showAttachments lists the attachments of a message and opens the chosen one
+// with its mailcap viewer.
+func showAttachments(messageId string, messageBody *tview.TextView) {
+	if messageId == "" {
+		return
+	}
+
+	service := ui.Client.ActiveService
+	runTask("Loading attachments", func(ctx context.Context) ([]api.Attachment, error) {
+		return getAttachments(service, messageId)
+	}, func(attachments []api.Attachment, err error) {
+		if err != nil {
+			showNotice(fmt.Sprintf("Error loading attachments: %v", err))
+			return
+		}
+		showAttachmentList(attachments, messageBody)
+	})
+}
+
+func showAttachmentList(attachments []api.Attachment, messageBody *tview.TextView) {
+	if len(attachments) == 0 {
+		showNotice("This message has no attachments.")
+		return
+	}
+
+	list := newList()
+	list.SetBorder(true).SetTitle("Attachments")
+	for i, a := range attachments {
+		var shortcut rune
+		if i < 9 {
+			shortcut = rune('1' + i)
+		}
+		list.AddItem(tview.Escape(a.Filename), tview.Escape(fmt.Sprintf("%s, %d bytes", a.ContentType, len(a.Data))), shortcut, nil)
+	}
+
+	list.SetSelectedFunc(func(i int, mainText, secondaryText string, r rune) {
+		hidePopup("attachments")
+		openAttachment(attachments[i], messageBody)
+	})
+	list.SetDoneFunc(func() {
+		hidePopup("attachments")
+	})
+
+	showPopup("attachments", list, 60, min(2*len(attachments)+2, 20))
+}
+
+// openedAttachment is an attachment written out for its mailcap viewer.
+type openedAttachment struct {
+	dir     string
+	entry   api.MailcapEntry
+	command string
+	stdin   bool
+	output  []byte // of a copiousoutput command
+}
+
+// openAttachment writes an attachment to a temporary file and runs the
+// matching mailcap command. Commands marked copiousoutput are shown in the
+// message pane; needsterminal commands take over the terminal until they exit.
+// The test commands of the entries and copiousoutput commands run in the
+// background.
+func openAttachment(a api.Attachment, messageBody *tview.TextView) {
+	if mailcap == nil {
+		var err error
+		mailcap, err = api.LoadMailcap(api.MailcapPaths(ui.Config.Viewer.Mailcap)...)
+		if err != nil {
+			showNotice(fmt.Sprintf("Error reading mailcap: %v", err))
+			return
+		}
+	}
+	table := mailcap
+
+	runTask("Opening "+a.Filename, func(ctx context.Context) (*openedAttachment, error) {
+		o, err := writeAttachment(a)
+		if err != nil {
+			return nil, err
+		}
+		file := filepath.Join(o.dir, attachmentName(a))
+		entry, ok := table.Lookup(a.ContentType, file)
+		if !ok {
+			os.RemoveAll(o.dir)
+			return nil, fmt.Errorf("no mailcap entry for %s", a.ContentType)
+		}
+		o.entry = entry
+		o.command, o.stdin = entry.Expand(file, a.ContentType)
+
+		if entry.CopiousOutput {
+			defer os.RemoveAll(o.dir)
+			o.output, err = o.cmd(a).Output()
+			if err != nil {
+				return nil, fmt.Errorf("running %q: %w", o.command, err)
+			}
+		}
+		return o, nil
+	}, func(o *openedAttachment, err error) {
+		if err != nil {
+			showNotice(err.Error())
+			return
+		}
+		if err := o.show(a, messageBody); err != nil {
+			showNotice(err.Error())
+		}
+	})
+}
+
+// show puts the output of a copiousoutput command in the message pane, or
+// runs the viewer.
+func (o *openedAttachment) show(a api.Attachment, messageBody *tview.TextView) error {
+	cmd := o.cmd(a)
+	switch {
+	case o.entry.CopiousOutput:
+		messageBody.SetText(tview.Escape(string(o.output)))
+		messageBody.ScrollToBeginning()
+		ui.App.SetFocus(messageBody)
+	case o.entry.NeedsTerminal:
+		defer os.RemoveAll(o.dir)
+		var err error
+		ui.App.Suspend(func() {
+			cmd.Stdout = os.Stdout
+			cmd.Stderr = os.Stderr
+			if cmd.Stdin == nil {
+				cmd.Stdin = os.Stdin
+			}
+			err = cmd.Run()
+		})
+		if err != nil {
+			return fmt.Errorf("running %q: %w", o.command, err)
+		}
+	default:
+		// graphical viewers outlive this call, so the file is left in place
+		if err := cmd.Start(); err != nil {
+			os.RemoveAll(o.dir)
+			return fmt.Errorf("running %q: %w", o.command, err)
+		}
+		go cmd.Wait()
+	}
+	return nil
+}
+
+func (o *openedAttachment) cmd(a api.Attachment) *exec.Cmd {
+	cmd := exec.Command("sh", "-c", o.command)
+	if o.stdin {
+		cmd.Stdin = bytes.NewReader(a.Data)
+	}
+	return cmd
+}
+
+// writeAttachment writes an attachment into a directory of its own, which
+// nobody else can have created or put links in.
+func writeAttachment(a api.Attachment) (*openedAttachment, error) {
+	dir, err := os.MkdirTemp("", "mailterm-")
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, attachmentName(a)), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err == nil {
+		_, err = f.Write(a.Data)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return &openedAttachment{dir: dir}, nil
+}
+
+// attachmentName is the file name an attachment is written under. The
+// sender picks the name and it ends up in a shell command, so everything
+// but letters, digits, dots, dashes and underscores is replaced, and a name
+// that could pass for an option or a hidden file is prefixed.
+func attachmentName(a api.Attachment) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, filepath.Base(a.Filename))
+	if name == "" || strings.Trim(name, ".") == "" {
+		return "attachment"
+	}
+	if name[0] == '-' || name[0] == '.' {
+		name = "attachment" + name
+	}
+	return name
+}
@@ -0,0 +1,289 @@
+package ui
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+)
+
+// command is something the ':' command line runs.
+type command struct {
+	name     string
+	args     string // how the argument is written, "" if it takes none
+	help     string
+	services []string // services the command works on; nil for all
+
+	// complete lists the values the argument can take on a service, if they
+	// are known. It runs in the background.
+	complete func(service string) []string
+	run      func(arg string)
+}
+
+// commands are the commands of the command line: the ones that take an
+// argument, then every key action by name.
+var commands []command
+
+// accounts are the services :account switches between, in the order of the
+// settings drop-down.
+var accounts = []string{"gmail", "graph", "imap"}
+
+func buildCommands(emailList *messageTable, settingsPane *tview.Form, listAction, messageAction func(action string)) []command {
+	cmds := []command{
+		{
+			name: "move", args: "<folder>", help: "move to a folder",
+			complete: func(service string) []string {
+				folders, err := getFolders(service)
+				if err != nil {
+					return nil
+				}
+				var names []string
+				for _, f := range folders {
+					names = append(names, f.Name)
+				}
+				return names
+			},
+			run: func(arg string) {
+				if arg == "" {
+					moveSelected(emailList)
+					return
+				}
+				moveToFolderNamed(emailList, arg)
+			},
+		},
+		{
+			name: "search", args: "<query>", help: "search messages; no query lists all again",
+			run: func(arg string) {
+				emailList.filter.Query = arg
+				populateEmailList(emailList)
+			},
+		},
+		{
+			name: "account", args: "<" + strings.Join(accounts, "|") + ">", help: "switch account",
+			complete: func(string) []string { return accounts },
+			run: func(arg string) {
+				i := slices.Index(accounts, strings.ToLower(arg))
+				if i < 0 {
+					showNotice(fmt.Sprintf("Unknown account %q. Use one of %s.", arg, strings.Join(accounts, ", ")))
+					return
+				}
+				selectOption(settingsPane, "Email Service", i)
+			},
+		},
+		{
+			name: "sort", args: "<" + strings.Join(sortKeys, "|") + "> [reverse]", help: "sort the list",
+			complete: func(string) []string {
+				var keys []string
+				for _, key := range sortKeys {
+					keys = append(keys, key, key+" reverse")
+				}
+				return keys
+			},
+			run: func(arg string) {
+				key, order, _ := strings.Cut(arg, " ")
+				if key == "" {
+					key = "date"
+				}
+				if order != "" && order != "reverse" {
+					showNotice(fmt.Sprintf("Unknown sort order %q.", order))
+					return
+				}
+				if err := emailList.SortBy(strings.ToLower(key), order == "reverse"); err != nil {
+					showNotice(err.Error())
+				}
+			},
+		},
+		{
+			name: "theme", args: "<name>", help: "change the color theme",
+			complete: func(string) []string { return themeNames() },
+			run: func(arg string) {
+				i := slices.Index(themeNames(), arg)
+				if i < 0 {
+					showNotice(fmt.Sprintf("Unknown theme %q.", arg))
+					return
+				}
+				selectOption(settingsPane, "Theme", i)
+			},
+		},
+	}
+
+	for _, context := range []string{contextList, contextMessage} {
+		for _, a := range keyActions {
+			if a.context != context || a.name == "command" || slices.ContainsFunc(cmds, func(c command) bool { return c.name == a.name }) {
+				continue
+			}
+			name := a.name
+			run := func(string) { messageAction(name) }
+			if context == contextList {
+				run = func(string) {
+					if key, ok := navigationKeys[name]; ok {
+						ui.App.SetFocus(emailList)
+						ui.App.QueueEvent(tcell.NewEventKey(key, 0, tcell.ModNone))
+						return
+					}
+					listAction(name)
+				}
+			}
+			cmds = append(cmds, command{name: name, help: a.help, services: a.services, run: run})
+		}
+	}
+	return cmds
+}
+
+// available reports whether the command works on the active service.
+func (c command) available() bool {
+	return c.services == nil || slices.Contains(c.services, ui.Client.ActiveService)
+}
+
+// selectOption picks an option of a settings drop-down as if the user had,
+// which runs its handler.
+func selectOption(form *tview.Form, label string, index int) {
+	if dropDown, ok := form.GetFormItemByLabel(label).(*tview.DropDown); ok {
+		dropDown.SetCurrentOption(index)
+	}
+}
+
+// findCommand looks a command up by its name or the start of one. It fails
+// if no command or more than one matches.
+func findCommand(name string) (command, error) {
+	var matches []command
+	for _, c := range commands {
+		if !c.available() {
+			continue
+		}
+		if c.name == name {
+			return c, nil
+		}
+		if strings.HasPrefix(c.name, name) {
+			matches = append(matches, c)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return command{}, fmt.Errorf("unknown command %q", name)
+	case 1:
+		return matches[0], nil
+	}
+	var names []string
+	for _, c := range matches {
+		names = append(names, c.name)
+	}
+	return command{}, fmt.Errorf("%q could be any of %s", name, strings.Join(names, ", "))
+}
+
+// runCommand runs a command line such as "move Archive".
+func runCommand(line string) {
+	name, arg, _ := strings.Cut(strings.TrimSpace(line), " ")
+	if name == "" {
+		return
+	}
+	c, err := findCommand(name)
+	if err != nil {
+		showNotice(err.Error())
+		return
+	}
+	c.run(strings.TrimSpace(arg))
+}
+
+// showCommandLine reads a command. Tab completes command names and the
+// arguments that have a known set of values.
+func showCommandLine() {
+	input := tview.NewInputField().
+		SetLabel(":").
+		SetFieldBackgroundColor(currentTheme.background).
+		SetFieldTextColor(currentTheme.text).
+		SetLabelColor(currentTheme.label)
+	input.SetAutocompleteStyles(currentTheme.input,
+		tcell.StyleDefault.Background(currentTheme.input).Foreground(currentTheme.inputText),
+		tcell.StyleDefault.Background(currentTheme.selected).Foreground(currentTheme.selectedText))
+	styleBox(input.Box, currentTheme)
+	input.SetBorder(true).SetTitle("Command")
+
+	// argument values are looked up once, since folders take a request
+	values := make(map[string][]string)
+	input.SetAutocompleteFunc(func(text string) []string {
+		return completeCommand(text, values, func() { input.Autocomplete() })
+	})
+	input.SetAutocompletedFunc(func(text string, index, source int) bool {
+		if source == tview.AutocompletedNavigate {
+			input.SetText(text)
+			return false
+		}
+		if c, err := findCommand(text); err == nil && c.name == text && c.args != "" {
+			text += " "
+		}
+		input.SetText(text)
+		reopenCompletions(input)
+		return true
+	})
+	input.SetDoneFunc(func(key tcell.Key) {
+		switch key {
+		case tcell.KeyTab:
+			reopenCompletions(input)
+		case tcell.KeyEnter:
+			hidePopup("command")
+			runCommand(input.GetText())
+		case tcell.KeyEscape:
+			hidePopup("command")
+		}
+	})
+
+	showPopup("command", input, 60, 3)
+}
+
+// reopenCompletions shows the completions of the text in the command line
+// once the input field has handled the key, which it does holding the lock
+// Autocomplete takes. It is called on the event goroutine, where queueing an
+// update waits for the update to run, so it queues it from another one.
+func reopenCompletions(input *tview.InputField) {
+	go ui.App.QueueUpdateDraw(func() {
+		input.Autocomplete()
+	})
+}
+
+// completeCommand lists the command lines text can be completed to. values
+// caches the argument values of each command; while they are being looked
+// up there are no completions, and refresh is called once they are in.
+func completeCommand(text string, values map[string][]string, refresh func()) []string {
+	var entries []string
+	name, arg, hasArg := strings.Cut(text, " ")
+	if !hasArg {
+		if name == "" {
+			return nil
+		}
+		for _, c := range commands {
+			if strings.HasPrefix(c.name, name) && c.available() {
+				entries = append(entries, c.name)
+			}
+		}
+	} else {
+		c, err := findCommand(name)
+		if err != nil || c.complete == nil {
+			return nil
+		}
+		if _, ok := values[c.name]; !ok {
+			values[c.name] = nil
+			service := ui.Client.ActiveService
+			runTask("Completing", func(ctx context.Context) ([]string, error) {
+				return c.complete(service), nil
+			}, func(v []string, err error) {
+				values[c.name] = v
+				refresh()
+			})
+			return nil
+		}
+		for _, value := range values[c.name] {
+			if strings.HasPrefix(strings.ToLower(value), strings.ToLower(arg)) {
+				entries = append(entries, c.name+" "+value)
+			}
+		}
+	}
+
+	if len(entries) == 1 && entries[0] == text {
+		return nil
+	}
+	return entries
+}
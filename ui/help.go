@@ -0,0 +1,72 @@
+package ui
+
+import (
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+)
+
+// showHelp lists the keys of a context and the commands of the command line.
+// Actions that do not work on the active service are left out.
+func showHelp(context string) {
+	t := currentTheme
+	table := tview.NewTable().
+		SetSelectable(false, false)
+	styleBox(table.Box, t)
+	title := "Help (Esc to close)"
+	if hint := keyHint(context, "help"); hint != "" {
+		title = "Help (" + hint + " or Esc to close)"
+	}
+	table.SetBorder(true).SetTitle(title)
+
+	heading := func(text string) {
+		row := table.GetRowCount()
+		if row > 0 {
+			row++ // a blank line before each section
+		}
+		table.SetCell(row, 0, tview.NewTableCell(text).
+			SetTextColor(t.title).
+			SetAttributes(tcell.AttrBold))
+	}
+	entry := func(keys, help string) {
+		row := table.GetRowCount()
+		table.SetCell(row, 0, tview.NewTableCell(tview.Escape(keys)).SetTextColor(t.label))
+		table.SetCell(row, 1, tview.NewTableCell(tview.Escape(help)).SetTextColor(t.text).SetExpansion(1))
+	}
+
+	heading("Keys")
+	for _, a := range keyActions {
+		if a.context != context || !actionAvailable(a, ui.Client.ActiveService) {
+			continue
+		}
+		entry(strings.Join(keyMaps[context].actions[a.name], " "), a.help)
+	}
+
+	// the command line is only listed where a key opens it
+	if hint := keyHint(context, "command"); hint != "" {
+		heading("Commands (" + hint + ")")
+		for _, c := range commands {
+			if !c.available() {
+				continue
+			}
+			line := ":" + c.name
+			if c.args != "" {
+				line += " " + c.args
+			}
+			entry(line, c.help)
+		}
+	}
+
+	// the keys that open help or quit close it; navigation keys scroll it
+	table.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		action, passed := keyMaps[context].handle(event)
+		if event.Key() == tcell.KeyEscape || action == "help" || action == "quit" {
+			hidePopup("help")
+			return nil
+		}
+		return passed
+	})
+
+	showPopup("help", table, 76, min(table.GetRowCount()+2, 30))
+}
@@ -0,0 +1,516 @@
+package ui
+
+import (
+	"cartsu/mailterm/api"
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// Key contexts: the widget that has focus when a key is pressed.
+const (
+	contextList     = "list"
+	contextMessage  = "message"
+	contextCompose  = "compose"
+	contextSettings = "settings"
+	contextLabels   = "labels" // the Gmail label browser
+)
+
+var (
+	sendingServices = []string{"gmail", "graph"}
+	gmailOnly       = []string{"gmail"}
+)
+
+// keyAction is something keys can be bound to in a context.
+type keyAction struct {
+	context  string
+	name     string
+	help     string
+	status   bool     // listed in the status bar
+	services []string // services the action works on; nil for all
+}
+
+// keyActions lists every action in the order help text shows them.
+var keyActions = []keyAction{
+	{contextList, "quit", "quit", true, nil},
+	{contextList, "new", "new", true, sendingServices},
+	{contextList, "reply", "reply", true, sendingServices},
+	{contextList, "forward", "forward", true, sendingServices},
+	{contextList, "delete", "delete", true, nil},
+	{contextList, "toggle_read", "read/unread", true, nil},
+	{contextList, "flag", "star", true, nil},
+	{contextList, "archive", "archive", true, nil},
+	{contextList, "move", "move", true, nil},
+	{contextList, "labels", "labels", true, gmailOnly},
+	{contextList, "label_browser", "label browser", false, gmailOnly},
+	{contextList, "tag", "tag", true, nil},
+	{contextList, "tag_pattern", "tag matching", false, nil},
+	{contextList, "tag_all", "tag all", false, nil},
+	{contextList, "clear_tags", "clear tags", false, nil},
+	{contextList, "undo", "undo", true, nil},
+	{contextList, "outbox", "outbox", true, sendingServices},
+	{contextList, "settings", "settings", true, nil},
+	{contextList, "help", "help", true, nil},
+	{contextList, "command", "command line", false, nil},
+	{contextList, "open", "open message", false, nil},
+	{contextList, "down", "next message", false, nil},
+	{contextList, "up", "previous message", false, nil},
+	{contextList, "top", "first message", false, nil},
+	{contextList, "bottom", "last message", false, nil},
+	{contextList, "page_down", "page down", false, nil},
+	{contextList, "page_up", "page up", false, nil},
+
+	{contextMessage, "back", "back to the list", true, nil},
+	{contextMessage, "quit", "quit", true, nil},
+	{contextMessage, "attachments", "attachments", true, nil},
+	{contextMessage, "links", "links", true, nil},
+	{contextMessage, "toggle_read", "read/unread", true, nil},
+	{contextMessage, "reply", "reply", true, sendingServices},
+	{contextMessage, "forward", "forward", true, sendingServices},
+	{contextMessage, "settings", "settings", true, nil},
+	{contextMessage, "help", "help", true, nil},
+	{contextMessage, "command", "command line", false, nil},
+	{contextMessage, "down", "scroll down", false, nil},
+	{contextMessage, "up", "scroll up", false, nil},
+	{contextMessage, "top", "top of message", false, nil},
+	{contextMessage, "bottom", "end of message", false, nil},
+	{contextMessage, "page_down", "page down", false, nil},
+	{contextMessage, "page_up", "page up", false, nil},
+
+	{contextCompose, "send", "send", true, nil},
+	{contextCompose, "cancel", "discard", true, nil},
+
+	{contextSettings, "close", "close settings", true, nil},
+	{contextSettings, "quit", "quit", true, nil},
+	{contextSettings, "next", "next setting", false, nil},
+	{contextSettings, "prev", "previous setting", false, nil},
+
+	{contextLabels, "create", "create label", true, gmailOnly},
+	{contextLabels, "rename", "rename label", true, gmailOnly},
+	{contextLabels, "delete", "delete label", true, gmailOnly},
+	{contextLabels, "help", "help", false, gmailOnly},
+}
+
+// navigationKeys turns navigation actions into the key the focused widget
+// already understands.
+var navigationKeys = map[string]tcell.Key{
+	"open":      tcell.KeyEnter,
+	"down":      tcell.KeyDown,
+	"up":        tcell.KeyUp,
+	"top":       tcell.KeyHome,
+	"bottom":    tcell.KeyEnd,
+	"page_down": tcell.KeyPgDn,
+	"page_up":   tcell.KeyPgUp,
+}
+
+// keyPresets are the base bindings, per context and action.
+var keyPresets = map[string]map[string]map[string][]string{
+	"default": {
+		contextList: {
+			"quit":          {"q"},
+			"new":           {"n"},
+			"reply":         {"r"},
+			"forward":       {"f"},
+			"delete":        {"d"},
+			"toggle_read":   {"u"},
+			"flag":          {"s"},
+			"archive":       {"e"},
+			"move":          {"m"},
+			"labels":        {"l"},
+			"label_browser": {"L"},
+			"tag":           {"t"},
+			"tag_pattern":   {"T"},
+			"tag_all":       {"*"},
+			"clear_tags":    {"<Esc>"},
+			"undo":          {"z"},
+			"outbox":        {"O"},
+			"settings":      {"<Tab>"},
+			"help":          {"?"},
+			"command":       {":"},
+			"open":          {"<Enter>"},
+		},
+		contextMessage: {
+			"back":        {"<Esc>"},
+			"quit":        {"q"},
+			"attachments": {"a"},
+			"links":       {"o"},
+			"toggle_read": {"u"},
+			"reply":       {"r"},
+			"forward":     {"f"},
+			"settings":    {"<Tab>"},
+			"help":        {"?"},
+			"command":     {":"},
+		},
+		contextCompose: {
+			"send":   {"<C-s>"},
+			"cancel": {"<Esc>"},
+		},
+		contextSettings: {
+			"close": {"<Esc>"},
+			"quit":  {"q"},
+			"next":  {"<Down>"},
+			"prev":  {"<Up>"},
+		},
+		contextLabels: {
+			"create": {"c"},
+			"rename": {"r"},
+			"delete": {"d"},
+			"help":   {"?"},
+		},
+	},
+}
+
+func init() {
+	// vim is the default preset with vi motions; the list keys that clash
+	// with them move under 'g'
+	vim := make(map[string]map[string][]string)
+	for context, actions := range keyPresets["default"] {
+		vim[context] = maps.Clone(actions)
+	}
+	maps.Copy(vim[contextList], map[string][]string{
+		"down":          {"j"},
+		"up":            {"k"},
+		"top":           {"gg"},
+		"bottom":        {"G"},
+		"page_down":     {"<C-d>"},
+		"page_up":       {"<C-u>"},
+		"open":          {"<Enter>", "l"},
+		"labels":        {"gl"},
+		"label_browser": {"gL"},
+		"delete":        {"dd"},
+	})
+	maps.Copy(vim[contextMessage], map[string][]string{
+		"back":      {"<Esc>", "h"},
+		"down":      {"j"},
+		"up":        {"k"},
+		"top":       {"gg"},
+		"bottom":    {"G"},
+		"page_down": {"<C-d>"},
+		"page_up":   {"<C-u>"},
+	})
+	keyPresets["vim"] = vim
+}
+
+// keyMap resolves the keys pressed in one context to actions. It remembers
+// the start of a multi-key sequence until the sequence is complete.
+type keyMap struct {
+	actions   map[string][]string // action -> sequences
+	sequences map[string]string   // sequence -> action
+	prefixes  map[string]bool
+	pending   string
+}
+
+// keyMaps holds the active bindings of every context.
+var keyMaps map[string]*keyMap
+
+// handle looks up a key. It returns the action the key completes, if any,
+// and the event to pass on to the focused widget: the event itself if the
+// key is not bound, the widget's own key for navigation actions and nil
+// otherwise.
+func (m *keyMap) handle(event *tcell.EventKey) (string, *tcell.EventKey) {
+	name := keyName(event)
+	if name == "" {
+		m.pending = ""
+		return "", event
+	}
+
+	sequence := m.pending + name
+	if _, ok := m.sequences[sequence]; !ok && !m.prefixes[sequence] && m.pending != "" {
+		// a broken sequence starts over from this key
+		sequence = name
+	}
+	m.pending = ""
+
+	if action, ok := m.sequences[sequence]; ok {
+		if key, ok := navigationKeys[action]; ok {
+			return action, tcell.NewEventKey(key, 0, tcell.ModNone)
+		}
+		return action, nil
+	}
+	if m.prefixes[sequence] {
+		m.pending = sequence
+		return "", nil
+	}
+	return "", event
+}
+
+// hint returns the first key sequence of an action as the status bar shows
+// it, or "" if the action is not bound.
+func (m *keyMap) hint(action string) string {
+	if len(m.actions[action]) == 0 {
+		return ""
+	}
+	return "'" + m.actions[action][0] + "'"
+}
+
+// keyHint is hint for the action in a context.
+func keyHint(context, action string) string {
+	return keyMaps[context].hint(action)
+}
+
+// actionAvailable reports whether an action works on a service.
+func actionAvailable(a keyAction, service string) bool {
+	return a.services == nil || slices.Contains(a.services, service)
+}
+
+// statusText lists the status bar actions of the message list that work on
+// the service, with their keys.
+func statusText(service string) string {
+	return actionHints(contextList, service)
+}
+
+// actionHints lists the status actions of a context that work on the
+// service, with their keys.
+func actionHints(context, service string) string {
+	var parts []string
+	for _, a := range keyActions {
+		if a.context != context || !a.status || !actionAvailable(a, service) {
+			continue
+		}
+		if hint := keyHint(a.context, a.name); hint != "" {
+			parts = append(parts, hint+" "+a.help)
+		}
+	}
+	return strings.Join(parts, " | ")
+}
+
+// loadKeyMaps builds the key maps from the preset and keys.json. If the file
+// is invalid the default bindings are used and the problems returned.
+func loadKeyMaps() error {
+	keyMaps, _ = buildKeyMaps(&api.KeysConfig{})
+
+	config, err := api.LoadKeysConfig()
+	if err != nil {
+		return err
+	}
+	loaded, err := buildKeyMaps(config)
+	if err != nil {
+		return err
+	}
+	keyMaps = loaded
+	return nil
+}
+
+func buildKeyMaps(config *api.KeysConfig) (map[string]*keyMap, error) {
+	presetName := config.Preset
+	if presetName == "" {
+		presetName = "default"
+	}
+	preset, ok := keyPresets[presetName]
+	if !ok {
+		return nil, fmt.Errorf("unknown key preset %q", presetName)
+	}
+
+	overrides := map[string]map[string]api.KeyList{
+		contextList:     config.List,
+		contextMessage:  config.Message,
+		contextCompose:  config.Compose,
+		contextSettings: config.Settings,
+		contextLabels:   config.Labels,
+	}
+
+	var problems []string
+	result := make(map[string]*keyMap)
+	for context, base := range preset {
+		actions := maps.Clone(base)
+		for action, keys := range overrides[context] {
+			if !knownAction(context, action) {
+				problems = append(problems, fmt.Sprintf("%s: unknown action %q", context, action))
+				continue
+			}
+			actions[action] = keys
+		}
+
+		m, err := newKeyMap(context, actions)
+		problems = append(problems, err...)
+		result[context] = m
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return nil, fmt.Errorf("invalid keybindings:\n%s", strings.Join(problems, "\n"))
+	}
+	return result, nil
+}
+
+func knownAction(context, name string) bool {
+	return slices.ContainsFunc(keyActions, func(a keyAction) bool {
+		return a.context == context && a.name == name
+	})
+}
+
+// newKeyMap parses the sequences of a context and checks them for
+// conflicts: a sequence bound to two actions, or one that is the start of
+// another and so could never complete it.
+func newKeyMap(context string, actions map[string][]string) (*keyMap, []string) {
+	m := &keyMap{
+		actions:   make(map[string][]string),
+		sequences: make(map[string]string),
+		prefixes:  make(map[string]bool),
+	}
+	var problems []string
+
+	var names []string
+	for action := range actions {
+		names = append(names, action)
+	}
+	sort.Strings(names)
+	for _, action := range names {
+		for _, text := range actions[action] {
+			keys, err := parseKeySequence(text)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%s.%s: %v", context, action, err))
+				continue
+			}
+			if context == contextCompose && utf8.RuneCountInString(keys[0]) == 1 {
+				problems = append(problems, fmt.Sprintf("%s.%s: %q would swallow typed text; start with a special key", context, action, text))
+				continue
+			}
+
+			sequence := strings.Join(keys, "")
+			if other, ok := m.sequences[sequence]; ok {
+				problems = append(problems, fmt.Sprintf("%s: %q is bound to both %s and %s", context, text, other, action))
+				continue
+			}
+			m.sequences[sequence] = action
+			m.actions[action] = append(m.actions[action], sequence)
+			for i := 1; i < len(keys); i++ {
+				m.prefixes[strings.Join(keys[:i], "")] = true
+			}
+		}
+	}
+
+	for sequence, action := range m.sequences {
+		if m.prefixes[sequence] {
+			problems = append(problems, fmt.Sprintf("%s: %q (%s) is the start of a longer sequence", context, sequence, action))
+		}
+	}
+	return m, problems
+}
+
+// specialKeys names the keys that are not plain characters.
+var specialKeys = map[tcell.Key]string{
+	tcell.KeyTab:        "<Tab>",
+	tcell.KeyBacktab:    "<S-Tab>",
+	tcell.KeyEnter:      "<Enter>",
+	tcell.KeyEscape:     "<Esc>",
+	tcell.KeyBackspace:  "<BS>",
+	tcell.KeyBackspace2: "<BS>",
+	tcell.KeyDelete:     "<Del>",
+	tcell.KeyInsert:     "<Insert>",
+	tcell.KeyUp:         "<Up>",
+	tcell.KeyDown:       "<Down>",
+	tcell.KeyLeft:       "<Left>",
+	tcell.KeyRight:      "<Right>",
+	tcell.KeyHome:       "<Home>",
+	tcell.KeyEnd:        "<End>",
+	tcell.KeyPgUp:       "<PgUp>",
+	tcell.KeyPgDn:       "<PgDn>",
+}
+
+func init() {
+	for i := 0; i < 12; i++ {
+		specialKeys[tcell.KeyF1+tcell.Key(i)] = fmt.Sprintf("<F%d>", i+1)
+	}
+}
+
+// keyName names a key press the way bindings are written: the character
+// itself, or a name in angle brackets such as <Esc>, <C-d> or <M-x>.
+func keyName(event *tcell.EventKey) string {
+	if event.Key() == tcell.KeyRune {
+		r := event.Rune()
+		name := string(r)
+		switch r {
+		case ' ':
+			name = "Space"
+		case '<':
+			name = "lt"
+		}
+		if event.Modifiers()&tcell.ModAlt != 0 {
+			return "<M-" + name + ">"
+		}
+		if len(name) > 1 {
+			return "<" + name + ">"
+		}
+		return name
+	}
+	if name, ok := specialKeys[event.Key()]; ok {
+		return name
+	}
+	if event.Key() >= tcell.KeyCtrlA && event.Key() <= tcell.KeyCtrlZ {
+		return fmt.Sprintf("<C-%c>", 'a'+rune(event.Key()-tcell.KeyCtrlA))
+	}
+	return ""
+}
+
+// parseKeySequence splits a binding such as "gg", "<C-x>s" or "<Esc>" into
+// key names as keyName reports them.
+func parseKeySequence(text string) ([]string, error) {
+	if text == "" {
+		return nil, fmt.Errorf("empty key sequence")
+	}
+
+	var keys []string
+	for text != "" {
+		if text[0] != '<' || !strings.Contains(text, ">") {
+			r, size := utf8.DecodeRuneInString(text)
+			keys = append(keys, string(r))
+			text = text[size:]
+			continue
+		}
+
+		end := strings.Index(text, ">")
+		name, err := canonicalKey(text[1:end])
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, name)
+		text = text[end+1:]
+	}
+	return keys, nil
+}
+
+// canonicalKey spells a bracketed key name the way keyName does, so that
+// "<esc>" and "<Esc>" are the same key.
+func canonicalKey(name string) (string, error) {
+	lower := strings.ToLower(name)
+	switch lower {
+	case "space":
+		return "<Space>", nil
+	case "lt":
+		return "<lt>", nil
+	case "c-h":
+		return "<BS>", nil // terminals send the same code for both
+	case "c-i":
+		return "<Tab>", nil
+	case "c-m":
+		return "<Enter>", nil
+	}
+
+	for _, special := range specialKeys {
+		if strings.ToLower(special) == "<"+lower+">" {
+			return special, nil
+		}
+	}
+	if r, ok := strings.CutPrefix(lower, "c-"); ok && len(r) == 1 && r[0] >= 'a' && r[0] <= 'z' {
+		return "<C-" + r + ">", nil
+	}
+	if len(name) > 2 && strings.EqualFold(name[:2], "m-") {
+		rest := name[2:]
+		if strings.EqualFold(rest, "space") {
+			rest = "Space"
+		}
+		if strings.EqualFold(rest, "lt") {
+			rest = "lt"
+		}
+		if utf8.RuneCountInString(rest) == 1 || rest == "Space" || rest == "lt" {
+			return "<M-" + rest + ">", nil
+		}
+	}
+	return "", fmt.Errorf("unknown key <%s>", name)
+}
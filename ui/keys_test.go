@@ -0,0 +1,193 @@
+package ui
+
+import (
+	"cartsu/mailterm/api"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+func TestParseKeySequence(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+		ok   bool
+	}{
+		{"d", []string{"d"}, true},
+		{"gg", []string{"g", "g"}, true},
+		{"<Esc>", []string{"<Esc>"}, true},
+		{"<esc>", []string{"<Esc>"}, true},
+		{"<c-X>s", []string{"<C-x>", "s"}, true},
+		{"<C-h>", []string{"<BS>"}, true},
+		{"<space>", []string{"<Space>"}, true},
+		{"<M-x>", []string{"<M-x>"}, true},
+		{"<m-space>", []string{"<M-Space>"}, true},
+		{"<f5>", []string{"<F5>"}, true},
+		{"<", []string{"<"}, true},
+		{"é", []string{"é"}, true},
+		{"", nil, false},
+		{"<Hyper-x>", nil, false},
+		{"<C-1>", nil, false},
+	}
+	for _, tt := range tests {
+		got, err := parseKeySequence(tt.text)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseKeySequence(%q) error = %v, want ok %v", tt.text, err, tt.ok)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseKeySequence(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestBuildKeyMaps(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   api.KeysConfig
+		problems []string // substrings of the error; nil if the config is valid
+		context  string
+		action   string
+		keys     []string
+	}{
+		{
+			name:    "default preset",
+			context: contextList, action: "delete", keys: []string{"d"},
+		},
+		{
+			name:    "vim preset",
+			config:  api.KeysConfig{Preset: "vim"},
+			context: contextList, action: "top", keys: []string{"gg"},
+		},
+		{
+			name:    "override replaces the preset's keys",
+			config:  api.KeysConfig{List: map[string]api.KeyList{"archive": {"a", "<C-e>"}}},
+			context: contextList, action: "archive", keys: []string{"a", "<C-e>"},
+		},
+		{
+			name:    "empty list unbinds",
+			config:  api.KeysConfig{Message: map[string]api.KeyList{"links": {}}},
+			context: contextMessage, action: "links", keys: nil,
+		},
+		{
+			name:    "label browser keys",
+			config:  api.KeysConfig{Labels: map[string]api.KeyList{"create": {"n"}}},
+			context: contextLabels, action: "create", keys: []string{"n"},
+		},
+		{
+			name:     "label browser conflict",
+			config:   api.KeysConfig{Labels: map[string]api.KeyList{"rename": {"d"}}},
+			problems: []string{`labels: "d" is bound to both delete and rename`},
+		},
+		{
+			name:     "unknown preset",
+			config:   api.KeysConfig{Preset: "emacs"},
+			problems: []string{`unknown key preset "emacs"`},
+		},
+		{
+			name:     "unknown action",
+			config:   api.KeysConfig{List: map[string]api.KeyList{"explode": {"x"}}},
+			problems: []string{`list: unknown action "explode"`},
+		},
+		{
+			name:     "action from another context",
+			config:   api.KeysConfig{Compose: map[string]api.KeyList{"archive": {"<C-a>"}}},
+			problems: []string{`compose: unknown action "archive"`},
+		},
+		{
+			name:     "same key for two actions",
+			config:   api.KeysConfig{List: map[string]api.KeyList{"archive": {"d"}}},
+			problems: []string{`list: "d" is bound to both archive and delete`},
+		},
+		{
+			name:     "key that starts a longer sequence",
+			config:   api.KeysConfig{Preset: "vim", List: map[string]api.KeyList{"archive": {"g"}}},
+			problems: []string{`list: "g" (archive) is the start of a longer sequence`},
+		},
+		{
+			name:     "plain character in compose",
+			config:   api.KeysConfig{Compose: map[string]api.KeyList{"send": {"s"}}},
+			problems: []string{`compose.send: "s" would swallow typed text`},
+		},
+		{
+			name:     "unparsable key",
+			config:   api.KeysConfig{Settings: map[string]api.KeyList{"close": {"<Nope>"}}},
+			problems: []string{"settings.close: unknown key <Nope>"},
+		},
+		{
+			name: "every problem is reported",
+			config: api.KeysConfig{
+				List:    map[string]api.KeyList{"explode": {"x"}, "archive": {"d"}},
+				Compose: map[string]api.KeyList{"send": {"s"}},
+			},
+			problems: []string{"unknown action", "bound to both", "would swallow"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			built, err := buildKeyMaps(&tt.config)
+			if tt.problems != nil {
+				if err == nil {
+					t.Fatalf("buildKeyMaps succeeded, want an error")
+				}
+				for _, p := range tt.problems {
+					if !strings.Contains(err.Error(), p) {
+						t.Errorf("error %q does not mention %q", err, p)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := built[tt.context].actions[tt.action]; !reflect.DeepEqual(got, tt.keys) {
+				t.Errorf("%s.%s = %q, want %q", tt.context, tt.action, got, tt.keys)
+			}
+		})
+	}
+}
+
+func TestKeyMapHandle(t *testing.T) {
+	built, err := buildKeyMaps(&api.KeysConfig{Preset: "vim"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := built[contextList]
+
+	press := func(r rune) *tcell.EventKey { return tcell.NewEventKey(tcell.KeyRune, r, tcell.ModNone) }
+	tests := []struct {
+		name    string
+		keys    []*tcell.EventKey
+		action  string
+		passKey tcell.Key // key passed on to the widget; 0 for none
+	}{
+		{"single key", []*tcell.EventKey{press('z')}, "undo", 0},
+		{"sequence", []*tcell.EventKey{press('d'), press('d')}, "delete", 0},
+		{"navigation", []*tcell.EventKey{press('g'), press('g')}, "top", tcell.KeyHome},
+		{"broken sequence starts over", []*tcell.EventKey{press('g'), press('j')}, "down", tcell.KeyDown},
+		{"control key", []*tcell.EventKey{tcell.NewEventKey(tcell.KeyCtrlD, 0, tcell.ModCtrl)}, "page_down", tcell.KeyPgDn},
+		{"unbound key passes through", []*tcell.EventKey{press('x')}, "", tcell.KeyRune},
+	}
+	for _, tt := range tests {
+		var action string
+		var event *tcell.EventKey
+		for _, key := range tt.keys {
+			action, event = m.handle(key)
+		}
+		if action != tt.action {
+			t.Errorf("%s: action = %q, want %q", tt.name, action, tt.action)
+		}
+		switch {
+		case tt.passKey == 0 && event != nil:
+			t.Errorf("%s: passed on %v, want nothing", tt.name, event.Name())
+		case tt.passKey != 0 && (event == nil || event.Key() != tt.passKey):
+			t.Errorf("%s: passed on %v, want key %v", tt.name, event, tt.passKey)
+		}
+		if m.pending != "" {
+			t.Errorf("%s: sequence %q left pending", tt.name, m.pending)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package ui
+
+import (
+	"cartsu/mailterm/api"
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+	"google.golang.org/api/gmail/v1"
+)
+
+// messagesPanel frames the message list; its title names the active label.
+var messagesPanel *tview.Flex
+
+// clearLabelFilter goes back to listing every thread.
+func clearLabelFilter(emailList *messageTable) {
+	emailList.filter = api.ThreadFilter{}
+	emailList.filterName = ""
+	updateListTitle(emailList)
+}
+
+// updateListTitle names the active label and search and counts the tagged
+// messages in the title of the message panel.
+func updateListTitle(emailList *messageTable) {
+	title := "Messages"
+	if emailList.filterName != "" {
+		title += ": " + tview.Escape(emailList.filterName)
+	}
+	if q := emailList.filter.Query; q != "" {
+		title += fmt.Sprintf(" matching %q", tview.Escape(q))
+	}
+	if n := emailList.TagCount(); n > 0 {
+		title += fmt.Sprintf(" (%d tagged)", n)
+	}
+	messagesPanel.SetTitle(title)
+}
+
+// labelText renders a label name in the label's own colors, if it has any.
+func labelText(label *gmail.Label) string {
+	name := tview.Escape(label.Name)
+	if label.Color == nil || label.Color.TextColor == "" {
+		return name
+	}
+	return fmt.Sprintf("[%s:%s]%s[-:-]", label.Color.TextColor, label.Color.BackgroundColor, name)
+}
+
+// showLabelBrowser lists the Gmail labels. Enter shows the threads under a
+// label; the keys of the labels context create, rename and delete user
+// labels.
+func showLabelBrowser(emailList *messageTable) {
+	if ui.Client.ActiveService != "gmail" {
+		showNotice("Labels are only available for Gmail.")
+		return
+	}
+
+	runTask("Loading labels", func(ctx context.Context) ([]*gmail.Label, error) {
+		return ui.Client.GmailClient.GetLabels()
+	}, func(labels []*gmail.Label, err error) {
+		if err != nil {
+			showNotice(fmt.Sprintf("Error loading labels: %v", err))
+			return
+		}
+		showLabelList(emailList, labels)
+	})
+}
+
+func showLabelList(emailList *messageTable, labels []*gmail.Label) {
+	list := newList().
+		ShowSecondaryText(false)
+	title := "Labels"
+	if hints := actionHints(contextLabels, ui.Client.ActiveService); hints != "" {
+		title += " (" + hints + ")"
+	}
+	list.SetBorder(true).SetTitle(title)
+	list.AddItem("All mail", "", 0, nil)
+	for _, label := range labels {
+		list.AddItem(labelText(label), "", 0, nil)
+	}
+
+	// selected returns the label under the cursor, or nil for "All mail"
+	selected := func() *gmail.Label {
+		i := list.GetCurrentItem()
+		if i <= 0 || i > len(labels) {
+			return nil
+		}
+		return labels[i-1]
+	}
+	// labelChanged shows the labels again after a change
+	labelChanged := func(err error) {
+		if err != nil {
+			showNotice(err.Error())
+			return
+		}
+		hidePopup("labels")
+		showLabelBrowser(emailList)
+	}
+
+	list.SetSelectedFunc(func(i int, mainText, secondaryText string, r rune) {
+		label := selected()
+		hidePopup("labels")
+		if label == nil {
+			clearLabelFilter(emailList)
+		} else {
+			emailList.filter.LabelId = label.Id
+			emailList.filterName = label.Name
+		}
+		populateEmailList(emailList)
+	})
+	list.SetDoneFunc(func() {
+		hidePopup("labels")
+	})
+	list.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		action, next := lookupKey(contextLabels, event)
+		label := selected()
+		switch action {
+		case "create":
+			showPrompt("New label", "", func(name string) {
+				if name == "" {
+					return
+				}
+				runWrite("Creating label", func() error {
+					_, err := ui.Client.GmailClient.CreateLabel(name)
+					return err
+				}, labelChanged)
+			})
+		case "rename":
+			if label == nil || label.Type != "user" {
+				return nil
+			}
+			showPrompt("Rename label", label.Name, func(name string) {
+				if name == "" || name == label.Name {
+					return
+				}
+				runWrite("Renaming label", func() error {
+					return ui.Client.GmailClient.RenameLabel(label.Id, name)
+				}, labelChanged)
+			})
+		case "delete":
+			if label == nil || label.Type != "user" {
+				return nil
+			}
+			showConfirm(fmt.Sprintf("Delete label %q? Threads keep their other labels.", label.Name), func() {
+				runWrite("Deleting label", func() error {
+					return ui.Client.GmailClient.DeleteLabel(label.Id)
+				}, labelChanged)
+			})
+		case "help":
+			showHelp(contextLabels)
+		}
+		return next
+	})
+
+	showPopup("labels", list, 50, min(len(labels)+3, 24))
+}
+
+// showThreadLabels lets the user apply and remove user labels on the tagged
+// threads, or the selected one. Enter toggles the label under the cursor: it
+// is removed if every thread has it and applied to all of them otherwise.
+func showThreadLabels(emailList *messageTable) {
+	if ui.Client.ActiveService != "gmail" {
+		showNotice("Labels are only available for Gmail.")
+		return
+	}
+	messages := emailList.Targets()
+	if len(messages) == 0 {
+		return
+	}
+
+	runTask("Loading labels", func(ctx context.Context) ([]*gmail.Label, error) {
+		return ui.Client.GmailClient.GetLabels()
+	}, func(labels []*gmail.Label, err error) {
+		if err != nil {
+			showNotice(fmt.Sprintf("Error loading labels: %v", err))
+			return
+		}
+		showThreadLabelList(emailList, messages, labels)
+	})
+}
+
+func showThreadLabelList(emailList *messageTable, messages []api.MessageSummary, all []*gmail.Label) {
+	var labels []*gmail.Label
+	for _, label := range all {
+		if label.Type == "user" {
+			labels = append(labels, label)
+		}
+	}
+	if len(labels) == 0 {
+		showNotice("There are no user labels yet. Create one with the label browser.")
+		return
+	}
+
+	list := newList().
+		ShowSecondaryText(false)
+	if len(messages) == 1 {
+		list.SetBorder(true).SetTitle("Labels for this thread")
+	} else {
+		list.SetBorder(true).SetTitle(fmt.Sprintf("Labels for %d threads", len(messages)))
+	}
+
+	// count returns how many of the threads have a label
+	count := func(label *gmail.Label) int {
+		n := 0
+		for _, m := range messages {
+			if slices.Contains(m.Labels, label.Id) {
+				n++
+			}
+		}
+		return n
+	}
+	itemText := func(label *gmail.Label) string {
+		switch count(label) {
+		case 0:
+			return "  " + labelText(label)
+		case len(messages):
+			return "✓ " + labelText(label)
+		default:
+			return "- " + labelText(label)
+		}
+	}
+	for _, label := range labels {
+		list.AddItem(itemText(label), "", 0, nil)
+	}
+
+	list.SetSelectedFunc(func(i int, mainText, secondaryText string, r rune) {
+		label := labels[i]
+		before := slices.Clone(messages)
+		var add, remove []string
+		var description string
+		if count(label) == len(messages) {
+			remove = []string{label.Id}
+			description = fmt.Sprintf("Removed label %q from %d thread(s)", label.Name, len(messages))
+		} else {
+			add = []string{label.Id}
+			description = fmt.Sprintf("Labelled %d thread(s) %q", len(messages), label.Name)
+		}
+
+		for j, m := range messages {
+			ids := slices.DeleteFunc(slices.Clone(m.Labels), func(id string) bool {
+				return id == label.Id
+			})
+			messages[j].Labels = append(ids, add...)
+		}
+		updateAction(emailList, before, slices.Clone(messages), description,
+			func() error { return ui.Client.GmailClient.ModifyThreadLabels(threadIds(before), add, remove) },
+			restoreGmailLabels(before, add, remove))
+		list.SetItemText(i, itemText(label), "")
+	})
+	list.SetDoneFunc(func() {
+		hidePopup("labels")
+	})
+
+	showPopup("labels", list, 50, min(len(labels)+2, 24))
+}
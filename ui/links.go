@@ -0,0 +1,171 @@
+package ui
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+)
+
+// urlPattern stops at brackets so that matches are safe inside tview tags.
+var urlPattern = regexp.MustCompile(`(?i)\b(?:https?://|mailto:|www\.)[^\s<>"'\[\]]+`)
+
+// extractURLs returns the distinct links in text, in order of appearance.
+// HTML hrefs are included because the renderer lists them as footnotes.
+func extractURLs(text string) []string {
+	var urls []string
+	seen := make(map[string]bool)
+	for _, match := range urlPattern.FindAllString(text, -1) {
+		url := trimURL(match)
+		if !seen[url] {
+			seen[url] = true
+			urls = append(urls, url)
+		}
+	}
+	return urls
+}
+
+// trimURL drops sentence punctuation that the pattern picks up at the end.
+func trimURL(url string) string {
+	url = strings.TrimRight(url, ".,;:!?")
+	if strings.HasSuffix(url, ")") && !strings.Contains(url, "(") {
+		url = strings.TrimSuffix(url, ")")
+	}
+	return url
+}
+
+// linkify wraps the links of rendered text in OSC 8 hyperlink tags.
+func linkify(text string) string {
+	return urlPattern.ReplaceAllStringFunc(text, func(match string) string {
+		url := trimURL(match)
+		target := url
+		if strings.HasPrefix(strings.ToLower(url), "www.") {
+			target = "https://" + url
+		}
+		return fmt.Sprintf("[:::%s]%s[:::-]%s", target, url, strings.TrimPrefix(match, url))
+	})
+}
+
+// showLinks lists the links of the open message. Enter opens the selected
+// link, 'y' copies it.
+func showLinks(messageBody *tview.TextView) {
+	urls := extractURLs(messageBody.GetText(true))
+	if len(urls) == 0 {
+		showNotice("No links found in this message.")
+		return
+	}
+
+	list := newList().
+		ShowSecondaryText(false)
+	list.SetBorder(true).SetTitle("Links ('y' copy)")
+	for i, url := range urls {
+		var shortcut rune
+		if i < 9 {
+			shortcut = rune('1' + i)
+		}
+		list.AddItem(tview.Escape(url), "", shortcut, nil)
+	}
+
+	list.SetSelectedFunc(func(i int, mainText, secondaryText string, r rune) {
+		hidePopup("links")
+		if err := openURL(urls[i]); err != nil {
+			showNotice(err.Error())
+		}
+	})
+	list.SetDoneFunc(func() {
+		hidePopup("links")
+	})
+	list.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		if event.Key() == tcell.KeyRune && event.Rune() == 'y' {
+			hidePopup("links")
+			if err := copyText(urls[list.GetCurrentItem()]); err != nil {
+				showNotice(err.Error())
+			}
+			return nil
+		}
+		return event
+	})
+
+	showPopup("links", list, 80, min(len(urls)+2, 20))
+}
+
+// openURL hands a link to the configured browser command, $BROWSER or the
+// platform opener. A %s in the command is replaced by the link, otherwise the
+// link is appended. The command is split into words and run without a
+// shell, since the link comes from the message.
+func openURL(url string) error {
+	command := ui.Config.Viewer.BrowserCommand
+	if command == "" {
+		command = os.Getenv("BROWSER")
+	}
+	if command == "" {
+		command = "xdg-open"
+		if runtime.GOOS == "darwin" {
+			command = "open"
+		}
+	}
+
+	if strings.HasPrefix(strings.ToLower(url), "www.") {
+		url = "https://" + url
+	}
+	args := browserArgs(command, url)
+	if len(args) == 0 {
+		return fmt.Errorf("opening link: no browser command")
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("opening link: %w", err)
+	}
+	go cmd.Wait()
+	return nil
+}
+
+// browserArgs splits a browser command into words and puts url in place of
+// %s, or after the last word. Quotes written around %s, as in "firefox
+// '%s'", are dropped.
+func browserArgs(command, url string) []string {
+	args := strings.Fields(command)
+	substituted := false
+	for i, arg := range args {
+		if !strings.Contains(arg, "%s") {
+			continue
+		}
+		if arg == "'%s'" || arg == `"%s"` {
+			arg = "%s"
+		}
+		args[i] = strings.ReplaceAll(arg, "%s", url)
+		substituted = true
+	}
+	if !substituted && len(args) > 0 {
+		args = append(args, url)
+	}
+	return args
+}
+
+// copyText puts text on the clipboard with the configured copy command, or
+// asks the terminal to do it with an OSC 52 escape sequence.
+func copyText(text string) error {
+	if command := ui.Config.Viewer.CopyCommand; command != "" {
+		cmd := exec.Command("sh", "-c", command)
+		cmd.Stdin = strings.NewReader(text)
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("copying link: %w", err)
+		}
+		return nil
+	}
+
+	tty, err := os.OpenFile("/dev/tty", os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("copying link: %w", err)
+	}
+	defer tty.Close()
+	_, err = fmt.Fprintf(tty, "\x1b]52;c;%s\a", base64.StdEncoding.EncodeToString([]byte(text)))
+	return err
+}
@@ -0,0 +1,412 @@
+package ui
+
+import (
+	"cartsu/mailterm/api"
+	"fmt"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+)
+
+var defaultColumns = []api.ColumnConfig{
+	{Name: "flags", Width: 3},
+	{Name: "date", Width: 10},
+	{Name: "from", Width: 20},
+	{Name: "subject", Width: 0},
+}
+
+// messageTable is the message list. Row i shows messages[i]. It also keeps
+// the filter and pagination cursor of the view it shows, the ids of the
+// messages tagged for a batch action and the order the user sorted by.
+type messageTable struct {
+	*tview.Table
+	messages []api.MessageSummary
+	columns  []api.ColumnConfig
+	tagged   map[string]bool
+
+	sortKey     string // "" keeps the order of the service
+	sortReverse bool
+
+	filter     api.ThreadFilter
+	filterName string
+	cursor     string
+	exhausted  bool
+	load       *task // the page being loaded, if any
+}
+
+func newMessageTable(columns []api.ColumnConfig) *messageTable {
+	if len(columns) == 0 {
+		columns = defaultColumns
+	}
+
+	t := &messageTable{
+		Table: tview.NewTable().
+			SetSelectable(true, false),
+		columns: columns,
+		tagged:  make(map[string]bool),
+	}
+	onTheme(func(th *theme) {
+		t.SetBackgroundColor(th.background)
+		t.SetSelectedStyle(tcell.StyleDefault.Background(th.selected).Foreground(th.selectedText))
+		for row := range t.messages {
+			t.renderRow(row)
+		}
+	})
+	return t
+}
+
+// Clear removes all messages and rewinds the cursor to the first page.
+func (t *messageTable) Clear() {
+	t.Table.Clear()
+	t.messages = nil
+	clear(t.tagged)
+	t.cursor = ""
+	t.exhausted = false
+}
+
+// Append adds messages to the end of the list, or into place if the list is
+// sorted. Messages already listed, which a page can repeat once new mail has
+// been merged in above it, are updated instead.
+func (t *messageTable) Append(messages []api.MessageSummary) {
+	for _, m := range messages {
+		if t.Index(m.Id) >= 0 {
+			t.Update(m)
+			continue
+		}
+		t.messages = append(t.messages, m)
+		t.renderRow(len(t.messages) - 1)
+	}
+	if t.sortKey != "" {
+		t.sort()
+	}
+}
+
+// sortKeys are the orders the list can be sorted in.
+var sortKeys = []string{"date", "from", "subject", "unread"}
+
+// SortBy sorts the loaded messages and the pages loaded after them. The
+// "date" order, newest first, is the service's own and clears the sort.
+func (t *messageTable) SortBy(key string, reverse bool) error {
+	if !slices.Contains(sortKeys, key) {
+		return fmt.Errorf("cannot sort by %q; use one of %s", key, strings.Join(sortKeys, ", "))
+	}
+	t.sortKey = key
+	t.sortReverse = reverse
+	if key == "date" && !reverse {
+		t.sortKey = ""
+	}
+	t.sort()
+	return nil
+}
+
+// sort puts the messages in the sort order, keeping the selected one
+// selected.
+func (t *messageTable) sort() {
+	current := t.CurrentId()
+	slices.SortStableFunc(t.messages, t.compare())
+	for row := range t.messages {
+		t.renderRow(row)
+	}
+	if row := t.Index(current); row >= 0 {
+		t.Select(row, 0)
+	}
+}
+
+// compare returns the comparison of the sort order.
+func (t *messageTable) compare() func(a, b api.MessageSummary) int {
+	compare := func(a, b api.MessageSummary) int {
+		return b.Date.Compare(a.Date)
+	}
+	switch t.sortKey {
+	case "from":
+		compare = func(a, b api.MessageSummary) int {
+			return strings.Compare(strings.ToLower(a.From), strings.ToLower(b.From))
+		}
+	case "subject":
+		compare = func(a, b api.MessageSummary) int {
+			return strings.Compare(strings.ToLower(a.Subject), strings.ToLower(b.Subject))
+		}
+	case "unread":
+		compare = func(a, b api.MessageSummary) int {
+			if a.Unread != b.Unread {
+				if a.Unread {
+					return -1
+				}
+				return 1
+			}
+			return b.Date.Compare(a.Date)
+		}
+	}
+	if t.sortReverse {
+		forward := compare
+		compare = func(a, b api.MessageSummary) int { return forward(b, a) }
+	}
+	return compare
+}
+
+// Merge brings the list up to date with a fresh copy of its first page in
+// the service's order. Messages new to the page are added and changed ones
+// updated. Listed messages missing from the page are removed if they fall in
+// the span it covers, or if whole says the page is the entire list; older
+// ones belong to later pages and are kept. The selected message stays
+// selected at the same height on screen. Merge reports whether anything
+// changed.
+func (t *messageTable) Merge(first []api.MessageSummary, whole bool) bool {
+	fresh := make(map[string]bool, len(first))
+	for _, m := range first {
+		fresh[m.Id] = true
+	}
+
+	merged := slices.Clone(first)
+	for _, m := range t.messages {
+		if fresh[m.Id] {
+			continue
+		}
+		if whole || len(first) > 0 && !m.Date.Before(first[len(first)-1].Date) {
+			continue
+		}
+		merged = append(merged, m)
+	}
+	if t.sortKey != "" {
+		slices.SortStableFunc(merged, t.compare())
+	}
+	if reflect.DeepEqual(merged, t.messages) {
+		return false
+	}
+
+	current := t.CurrentId()
+	row, _ := t.GetSelection()
+	offset, _ := t.GetOffset()
+
+	for id := range t.tagged {
+		if !slices.ContainsFunc(merged, func(m api.MessageSummary) bool { return m.Id == id }) {
+			delete(t.tagged, id)
+		}
+	}
+	t.messages = merged
+	t.Table.Clear()
+	for r := range t.messages {
+		t.renderRow(r)
+	}
+
+	selected := t.Index(current)
+	if selected < 0 {
+		selected = min(row, len(t.messages)-1)
+	}
+	if selected >= 0 {
+		t.Select(selected, 0)
+		t.SetOffset(max(offset+selected-row, 0), 0)
+	}
+	return true
+}
+
+// Update redraws the row of a message with new details.
+func (t *messageTable) Update(message api.MessageSummary) {
+	for i, m := range t.messages {
+		if m.Id == message.Id {
+			t.messages[i] = message
+			t.renderRow(i)
+			return
+		}
+	}
+}
+
+// Insert puts a message back at row, or at the end if the list is shorter.
+// A message that is already listed is left where it is.
+func (t *messageTable) Insert(row int, message api.MessageSummary) {
+	if t.Index(message.Id) >= 0 {
+		return
+	}
+	row = min(max(row, 0), len(t.messages))
+	t.messages = slices.Insert(t.messages, row, message)
+	t.InsertRow(row)
+	t.renderRow(row)
+}
+
+// Index returns the row of the message with the given id, or -1.
+func (t *messageTable) Index(id string) int {
+	return slices.IndexFunc(t.messages, func(m api.MessageSummary) bool { return m.Id == id })
+}
+
+// Remove deletes the row of the message with the given id.
+func (t *messageTable) Remove(id string) {
+	for i, m := range t.messages {
+		if m.Id == id {
+			t.messages = append(t.messages[:i], t.messages[i+1:]...)
+			delete(t.tagged, id)
+			t.RemoveRow(i)
+			return
+		}
+	}
+}
+
+// Current returns the selected message.
+func (t *messageTable) Current() (api.MessageSummary, bool) {
+	row, _ := t.GetSelection()
+	if row < 0 || row >= len(t.messages) {
+		return api.MessageSummary{}, false
+	}
+	return t.messages[row], true
+}
+
+// CurrentId returns the id of the selected message, or "" if there is none.
+func (t *messageTable) CurrentId() string {
+	m, _ := t.Current()
+	return m.Id
+}
+
+// ToggleTag tags or untags the selected message.
+func (t *messageTable) ToggleTag() {
+	m, ok := t.Current()
+	if !ok {
+		return
+	}
+	t.setTag(m.Id, !t.tagged[m.Id])
+}
+
+// TagAll tags every loaded message, or untags them all if they already are.
+func (t *messageTable) TagAll() {
+	tag := len(t.tagged) < len(t.messages)
+	for _, m := range t.messages {
+		t.setTag(m.Id, tag)
+	}
+}
+
+// TagMatching tags the loaded messages whose sender or subject matches
+// pattern and returns how many it tagged.
+func (t *messageTable) TagMatching(pattern *regexp.Regexp) int {
+	n := 0
+	for _, m := range t.messages {
+		if pattern.MatchString(m.From) || pattern.MatchString(m.Subject) {
+			t.setTag(m.Id, true)
+			n++
+		}
+	}
+	return n
+}
+
+// ClearTags untags every message.
+func (t *messageTable) ClearTags() {
+	for id := range t.tagged {
+		t.setTag(id, false)
+	}
+}
+
+// TagCount returns the number of tagged messages.
+func (t *messageTable) TagCount() int {
+	return len(t.tagged)
+}
+
+// Targets returns the messages an action applies to: the tagged ones in list
+// order if there are any, otherwise the selected one.
+func (t *messageTable) Targets() []api.MessageSummary {
+	if len(t.tagged) == 0 {
+		if m, ok := t.Current(); ok {
+			return []api.MessageSummary{m}
+		}
+		return nil
+	}
+
+	var targets []api.MessageSummary
+	for _, m := range t.messages {
+		if t.tagged[m.Id] {
+			targets = append(targets, m)
+		}
+	}
+	return targets
+}
+
+func (t *messageTable) setTag(id string, tag bool) {
+	if tag {
+		t.tagged[id] = true
+	} else {
+		delete(t.tagged, id)
+	}
+	for i, m := range t.messages {
+		if m.Id == id {
+			t.renderRow(i)
+			return
+		}
+	}
+}
+
+func (t *messageTable) renderRow(row int) {
+	m := t.messages[row]
+	now := time.Now()
+
+	for col, column := range t.columns {
+		var text string
+		switch column.Name {
+		case "flags":
+			text = messageFlags(m)
+		case "date":
+			text = relativeDate(m.Date, now)
+		case "from":
+			text = tview.Escape(m.From)
+		case "subject":
+			text = tview.Escape(m.Subject)
+		}
+
+		cell := tview.NewTableCell(text).
+			SetTextColor(currentTheme.unread).
+			SetMaxWidth(column.Width)
+		if column.Width == 0 {
+			cell.SetExpansion(1)
+		}
+		if m.Unread {
+			cell.SetAttributes(tcell.AttrBold)
+		} else {
+			cell.SetTextColor(currentTheme.read)
+		}
+		if t.tagged[m.Id] {
+			cell.SetBackgroundColor(currentTheme.tagged)
+		}
+		t.SetCell(row, col, cell)
+	}
+}
+
+// messageFlags marks unread (N), flagged (!) and attachment (@) messages.
+func messageFlags(m api.MessageSummary) string {
+	flags := []byte("   ")
+	if m.Unread {
+		flags[0] = 'N'
+	}
+	if m.Flagged {
+		flags[1] = '!'
+	}
+	if m.HasAttachment {
+		flags[2] = '@'
+	}
+	return string(flags)
+}
+
+// relativeDate formats t compactly relative to now.
+func relativeDate(t, now time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	t = t.Local()
+	age := now.Sub(t)
+	y1, m1, d1 := t.Date()
+	y2, m2, d2 := now.Date()
+
+	switch {
+	case age < time.Minute:
+		return "now"
+	case age < time.Hour:
+		return fmt.Sprintf("%dm ago", int(age.Minutes()))
+	case y1 == y2 && m1 == m2 && d1 == d2:
+		return t.Format("15:04")
+	case age < 6*24*time.Hour:
+		return t.Format("Mon 15:04")
+	case y1 == y2:
+		return t.Format("Jan 2")
+	default:
+		return t.Format("Jan 2006")
+	}
+}
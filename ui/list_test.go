@@ -0,0 +1,151 @@
+package ui
+
+import (
+	"cartsu/mailterm/api"
+	"reflect"
+	"slices"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestMessageTableMerge(t *testing.T) {
+	if currentTheme == nil {
+		var err error
+		if currentTheme, err = resolveTheme("default"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// message i is i hours old, so ids in ascending order are newest first
+	base := time.Date(2024, time.May, 1, 12, 0, 0, 0, time.UTC)
+	message := func(id int) api.MessageSummary {
+		return api.MessageSummary{
+			Id:      string(rune('a' + id)),
+			Subject: string(rune('z' - id)),
+			Date:    base.Add(-time.Duration(id) * time.Hour),
+		}
+	}
+	messages := func(ids ...int) []api.MessageSummary {
+		var list []api.MessageSummary
+		for _, id := range ids {
+			list = append(list, message(id))
+		}
+		return list
+	}
+	read := message(1)
+	read.Unread = false
+	read.Subject = "edited"
+
+	tests := []struct {
+		name     string
+		listed   []api.MessageSummary
+		selected string
+		tagged   []string
+		sortKey  string
+		first    []api.MessageSummary
+		whole    bool
+
+		changed      bool
+		want         string // ids in list order
+		wantSelected string
+		wantTagged   []string
+	}{
+		{
+			name:   "nothing new",
+			listed: messages(0, 1, 2, 3), selected: "b",
+			first:   messages(0, 1),
+			changed: false, want: "abcd", wantSelected: "b",
+		},
+		{
+			name:   "new mail on top keeps the selection",
+			listed: messages(1, 2, 3), selected: "c",
+			first:   messages(0, 1),
+			changed: true, want: "abcd", wantSelected: "c",
+		},
+		{
+			name:   "changed message is updated",
+			listed: messages(0, 1, 2), selected: "a",
+			first:   []api.MessageSummary{message(0), read},
+			changed: true, want: "abc", wantSelected: "a",
+		},
+		{
+			name:   "message gone from the page's span is removed",
+			listed: messages(0, 1, 2, 3, 4), selected: "a", tagged: []string{"b", "e"},
+			first:   messages(0, 2),
+			changed: true, want: "acde", wantSelected: "a", wantTagged: []string{"e"},
+		},
+		{
+			name:   "older pages are kept",
+			listed: messages(0, 1, 2, 3, 4), selected: "e",
+			first:   messages(0, 1),
+			changed: false, want: "abcde", wantSelected: "e",
+		},
+		{
+			name:   "whole list drops everything missing",
+			listed: messages(0, 1, 2, 3, 4), selected: "a", tagged: []string{"d"},
+			first: messages(0, 1), whole: true,
+			changed: true, want: "ab", wantSelected: "a",
+		},
+		{
+			name:   "removed selection stays on its row",
+			listed: messages(0, 1, 2, 3), selected: "c",
+			first: messages(0, 1, 3), whole: true,
+			changed: true, want: "abd", wantSelected: "d",
+		},
+		{
+			name:   "removed last row selects the new last row",
+			listed: messages(0, 1, 2), selected: "c",
+			first: messages(0, 1), whole: true,
+			changed: true, want: "ab", wantSelected: "b",
+		},
+		{
+			name:   "sorted list stays sorted",
+			listed: messages(1, 2, 3), selected: "b", sortKey: "subject",
+			first:   messages(0, 1),
+			changed: true, want: "dcba", wantSelected: "b",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			list := newMessageTable(nil)
+			list.sortKey = tt.sortKey
+			list.Append(tt.listed)
+			list.Select(list.Index(tt.selected), 0)
+			for _, id := range tt.tagged {
+				list.tagged[id] = true
+			}
+
+			if changed := list.Merge(tt.first, tt.whole); changed != tt.changed {
+				t.Errorf("Merge = %v, want %v", changed, tt.changed)
+			}
+			var got string
+			for _, m := range list.messages {
+				got += m.Id
+			}
+			if got != tt.want {
+				t.Errorf("list = %q, want %q", got, tt.want)
+			}
+			if list.GetRowCount() != len(list.messages) {
+				t.Errorf("table has %d rows for %d messages", list.GetRowCount(), len(list.messages))
+			}
+			if id := list.CurrentId(); id != tt.wantSelected {
+				t.Errorf("selected %q, want %q", id, tt.wantSelected)
+			}
+			var tagged []string
+			for id := range list.tagged {
+				tagged = append(tagged, id)
+			}
+			sort.Strings(tagged)
+			if !slices.Equal(tagged, tt.wantTagged) {
+				t.Errorf("tagged = %q, want %q", tagged, tt.wantTagged)
+			}
+			for _, m := range tt.first {
+				if i := list.Index(m.Id); i < 0 || !reflect.DeepEqual(list.messages[i], m) {
+					t.Errorf("message %q is not the page's copy", m.Id)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,204 @@
+package ui
+
+import (
+	"cartsu/mailterm/api"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+)
+
+const outboxPeriod = 30 * time.Second
+
+// outbox holds the scheduled messages. It is nil if outbox.json could not be
+// read, in which case scheduling is turned off rather than overwriting it.
+var outbox *api.Outbox
+
+// sendMessage sends a composed message through the active service. With a
+// send delay it is held back first and 'z' recalls it into the compose page.
+func sendMessage(root tview.Primitive, email api.Message) {
+	service := ui.Client.ActiveService
+	send := func() error {
+		return ui.Client.Send(service, email)
+	}
+
+	if ui.Config.UI.SendDelay <= 0 {
+		runWrite("Sending", send, func(err error) {
+			if err != nil {
+				showNotice(fmt.Sprintf("Error sending message: %s", err.Error()))
+			}
+		})
+		return
+	}
+	perform(&undoEntry{
+		description: fmt.Sprintf("Sending %q", email.Subject),
+		grace:       time.Duration(ui.Config.UI.SendDelay) * time.Second,
+		detached:    true,
+		commit:      send,
+		restore: func() {
+			ui.App.SetRoot(createDraftPage(root, email), true)
+		},
+	})
+}
+
+// scheduleMessage puts a message in the outbox to be sent at sendAt through
+// the active service.
+func scheduleMessage(email api.Message, sendAt time.Time) {
+	if outbox == nil {
+		showNotice("The outbox could not be read, so messages cannot be scheduled.")
+		return
+	}
+	if _, err := outbox.Schedule(ui.Client.ActiveService, email, sendAt); err != nil {
+		showNotice(fmt.Sprintf("Error scheduling message: %v", err))
+		return
+	}
+	flashStatus(fmt.Sprintf("Scheduled %q for %s.", email.Subject, sendAt.Format("Mon Jan 2 15:04")))
+}
+
+// parseSendTime reads a send time: "+2h30m" from now, "18:30" today (or
+// tomorrow if that has passed), "tomorrow 9:00" or "2006-01-02 15:04".
+func parseSendTime(text string, now time.Time) (time.Time, error) {
+	text = strings.TrimSpace(text)
+
+	if after, ok := strings.CutPrefix(text, "+"); ok {
+		d, err := time.ParseDuration(after)
+		if err != nil || d <= 0 {
+			return time.Time{}, fmt.Errorf("cannot read send time %q", text)
+		}
+		return now.Add(d), nil
+	}
+
+	if t, err := time.ParseInLocation("2006-01-02 15:04", text, now.Location()); err == nil {
+		if !t.After(now) {
+			return time.Time{}, fmt.Errorf("send time %s is in the past", text)
+		}
+		return t, nil
+	}
+
+	days := 0
+	if after, ok := strings.CutPrefix(text, "tomorrow"); ok {
+		days = 1
+		text = strings.TrimSpace(after)
+	}
+	clock, err := time.Parse("15:04", text)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("cannot read send time %q", text)
+	}
+	y, m, d := now.Date()
+	t := time.Date(y, m, d+days, clock.Hour(), clock.Minute(), 0, 0, now.Location())
+	if days == 0 && !t.After(now) {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// startOutbox loads the outbox and sends scheduled messages as they fall
+// due, including any that fell due while mailterm was not running.
+func startOutbox() {
+	var err error
+	outbox, err = api.LoadOutbox()
+	if err != nil {
+		log.Printf("Unable to load outbox: %v", err)
+		return
+	}
+
+	go func() {
+		for {
+			sendDue()
+			time.Sleep(outboxPeriod)
+		}
+	}()
+}
+
+// sendDue sends the scheduled messages whose time has come. Each is claimed
+// first, so that one recalled meanwhile is not sent as well. Messages that
+// fail stay in the outbox with the error and are tried again later.
+func sendDue() {
+	for _, m := range outbox.Due(time.Now()) {
+		if !outbox.Claim(m.Id) {
+			continue
+		}
+		err := ui.Client.Send(m.Service, m.Message)
+		if updateErr := outbox.Done(m.Id, err); updateErr != nil {
+			log.Printf("Unable to update outbox: %v", updateErr)
+		}
+
+		switch {
+		case err == nil:
+			ui.App.QueueUpdateDraw(func() {
+				flashStatus(fmt.Sprintf("Sent scheduled message %q.", m.Message.Subject))
+			})
+		case m.LastError != err.Error():
+			ui.App.QueueUpdateDraw(func() {
+				flashStatus(fmt.Sprintf("Scheduled message %q not sent: %v", m.Message.Subject, err))
+			})
+		}
+	}
+}
+
+// showOutbox lists the scheduled messages. Enter takes the selected one out
+// of the outbox and back into the compose page; 'd' cancels it.
+func showOutbox() {
+	if outbox == nil {
+		showNotice("The outbox could not be read.")
+		return
+	}
+	messages := outbox.Messages()
+	if len(messages) == 0 {
+		showNotice("No messages are scheduled.")
+		return
+	}
+
+	list := newList()
+	list.SetBorder(true).SetTitle("Outbox ('d' cancel)")
+	for _, m := range messages {
+		main := fmt.Sprintf("%s  %s: %s", m.SendAt.Format("Mon Jan 2 15:04"), m.Message.To, m.Message.Subject)
+		secondary := "via " + m.Service
+		if m.LastError != "" {
+			secondary = "not sent yet: " + m.LastError
+		}
+		list.AddItem(tview.Escape(main), tview.Escape(secondary), 0, nil)
+	}
+
+	list.SetSelectedFunc(func(i int, mainText, secondaryText string, r rune) {
+		hidePopup("outbox")
+		removed, err := outbox.Remove(messages[i].Id)
+		if err != nil {
+			showNotice(fmt.Sprintf("Error updating outbox: %v", err))
+			return
+		}
+		if !removed {
+			showNotice(fmt.Sprintf("%q is being sent or has been sent already.", messages[i].Message.Subject))
+			return
+		}
+		ui.App.SetRoot(createDraftPage(pages, messages[i].Message), true)
+	})
+	list.SetDoneFunc(func() {
+		hidePopup("outbox")
+	})
+	list.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		if event.Key() != tcell.KeyRune || event.Rune() != 'd' {
+			return event
+		}
+		m := messages[list.GetCurrentItem()]
+		showConfirm(fmt.Sprintf("Cancel sending %q?", m.Message.Subject), func() {
+			removed, err := outbox.Remove(m.Id)
+			if err != nil {
+				showNotice(fmt.Sprintf("Error updating outbox: %v", err))
+				return
+			}
+			hidePopup("outbox")
+			if !removed {
+				showNotice(fmt.Sprintf("%q is being sent or has been sent already.", m.Message.Subject))
+				return
+			}
+			showOutbox()
+		})
+		return nil
+	})
+
+	showPopup("outbox", list, 80, min(2*len(messages)+2, 20))
+}
@@ -0,0 +1,48 @@
+package ui
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSendTime(t *testing.T) {
+	now := time.Date(2024, time.March, 31, 14, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		text string
+		want time.Time
+		ok   bool
+	}{
+		{"+90m", now.Add(90 * time.Minute), true},
+		{" +2h ", now.Add(2 * time.Hour), true},
+		{"+0s", time.Time{}, false},
+		{"+-1h", time.Time{}, false},
+		{"+soon", time.Time{}, false},
+		{"2024-04-02 08:15", time.Date(2024, time.April, 2, 8, 15, 0, 0, time.UTC), true},
+		{"2024-03-31 14:30", time.Time{}, false},
+		{"2023-12-25 09:00", time.Time{}, false},
+		{"16:45", time.Date(2024, time.March, 31, 16, 45, 0, 0, time.UTC), true},
+		{"09:00", time.Date(2024, time.April, 1, 9, 0, 0, 0, time.UTC), true},
+		{"14:30", time.Date(2024, time.April, 1, 14, 30, 0, 0, time.UTC), true},
+		{"tomorrow 9:00", time.Date(2024, time.April, 1, 9, 0, 0, 0, time.UTC), true},
+		{"tomorrow 23:59", time.Date(2024, time.April, 1, 23, 59, 0, 0, time.UTC), true},
+		{"tomorrow", time.Time{}, false},
+		{"25:00", time.Time{}, false},
+		{"next week", time.Time{}, false},
+		{"", time.Time{}, false},
+	}
+	for _, tt := range tests {
+		got, err := parseSendTime(tt.text, now)
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("parseSendTime(%q) = %v, want an error", tt.text, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseSendTime(%q): %v", tt.text, err)
+		} else if !got.Equal(tt.want) {
+			t.Errorf("parseSendTime(%q) = %v, want %v", tt.text, got, tt.want)
+		}
+	}
+}
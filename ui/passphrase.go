@@ -0,0 +1,50 @@
+package ui
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/term"
+)
+
+// askPassphrase reads the passphrase of the secret vault on the terminal,
+// suspending the interface while it does if it is running.
+func askPassphrase(create bool) (string, error) {
+	var passphrase string
+	var err error
+	read := func() { passphrase, err = readPassphrase(create) }
+	if ui.App == nil || !ui.App.Suspend(read) {
+		read()
+	}
+	return passphrase, err
+}
+
+func readPassphrase(create bool) (string, error) {
+	prompt := func(text string) (string, error) {
+		fmt.Fprint(os.Stderr, text)
+		defer fmt.Fprintln(os.Stderr)
+		b, err := term.ReadPassword(int(os.Stdin.Fd()))
+		return string(b), err
+	}
+
+	if !create {
+		return prompt("MailTerm vault passphrase: ")
+	}
+	fmt.Fprintln(os.Stderr, "MailTerm keeps your passwords in a vault encrypted with a passphrase.")
+	passphrase, err := prompt("New vault passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	if passphrase == "" {
+		return "", errors.New("the vault passphrase cannot be empty")
+	}
+	repeated, err := prompt("Repeat the passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	if repeated != passphrase {
+		return "", errors.New("the passphrases do not match")
+	}
+	return passphrase, nil
+}
@@ -0,0 +1,96 @@
+package ui
+
+import (
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+)
+
+// popupFocus remembers what had focus before each popup was shown.
+var popupFocus = map[string]tview.Primitive{}
+
+// showPopup centers p over the main view and focuses it.
+func showPopup(name string, p tview.Primitive, width, height int) {
+	grid := tview.NewGrid().
+		SetColumns(0, width, 0).
+		SetRows(0, height, 0).
+		AddItem(p, 1, 1, 1, 1, 0, 0, true)
+
+	popupFocus[name] = ui.App.GetFocus()
+	pages.AddPage(name, grid, true, true)
+	ui.App.SetFocus(p)
+}
+
+// hidePopup removes a popup and gives focus back to where it was.
+func hidePopup(name string) {
+	pages.RemovePage(name)
+	if prev, ok := popupFocus[name]; ok && prev != nil {
+		ui.App.SetFocus(prev)
+	}
+	delete(popupFocus, name)
+}
+
+// notices are the messages waiting behind the notice on screen.
+var notices []string
+
+// showNotice shows a message over the main view until it is dismissed. If a
+// notice is already shown the message waits its turn behind it.
+func showNotice(message string) {
+	if pages.HasPage("notice") {
+		notices = append(notices, message)
+		return
+	}
+	popupFocus["notice"] = ui.App.GetFocus()
+	openNotice(message)
+}
+
+// openNotice puts up a notice. Dismissing it brings up the next one, or
+// gives focus back to where it was before the first.
+func openNotice(message string) {
+	modal := tview.NewModal().
+		SetText(message).
+		AddButtons([]string{"OK"}).
+		SetDoneFunc(func(buttonIndex int, buttonLabel string) {
+			if len(notices) > 0 {
+				next := notices[0]
+				notices = notices[1:]
+				pages.RemovePage("notice")
+				openNotice(next)
+				return
+			}
+			hidePopup("notice")
+		})
+	pages.AddPage("notice", modal, false, true)
+	ui.App.SetFocus(modal)
+}
+
+// showPrompt asks for a line of text. done is called with the text when
+// Enter is pressed; Escape cancels.
+func showPrompt(title, initial string, done func(text string)) {
+	input := tview.NewInputField().
+		SetText(initial)
+	input.SetBorder(true).SetTitle(title)
+	input.SetDoneFunc(func(key tcell.Key) {
+		hidePopup("prompt")
+		if key == tcell.KeyEnter {
+			done(input.GetText())
+		}
+	})
+
+	showPopup("prompt", input, 50, 3)
+}
+
+// showConfirm asks a yes/no question and calls yes if confirmed.
+func showConfirm(message string, yes func()) {
+	modal := tview.NewModal().
+		SetText(message).
+		AddButtons([]string{"Yes", "No"}).
+		SetDoneFunc(func(buttonIndex int, buttonLabel string) {
+			hidePopup("confirm")
+			if buttonLabel == "Yes" {
+				yes()
+			}
+		})
+	popupFocus["confirm"] = ui.App.GetFocus()
+	pages.AddPage("confirm", modal, false, true)
+	ui.App.SetFocus(modal)
+}
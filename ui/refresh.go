@@ -0,0 +1,96 @@
+package ui
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// refresh is the loop that keeps the message list in sync with the active
+// service while auto-refresh is on.
+var refresh struct {
+	cancel context.CancelFunc // stops the loop; nil if it is not running
+	sync   *task              // the sync in flight, if any
+}
+
+func refreshInterval() time.Duration {
+	if seconds := ui.Config.UI.RefreshInterval; seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return RefreshPeriod
+}
+
+// startAutoRefresh starts syncing the list with the active service every
+// refresh interval, stopping a loop already running.
+func startAutoRefresh(emailList *messageTable) {
+	stopAutoRefresh()
+	ctx, cancel := context.WithCancel(context.Background())
+	refresh.cancel = cancel
+
+	interval := refreshInterval()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				ui.App.QueueUpdateDraw(func() {
+					if ctx.Err() == nil {
+						syncEmailList(emailList)
+					}
+				})
+			}
+		}
+	}()
+}
+
+// stopAutoRefresh stops the sync loop and drops a sync in flight.
+func stopAutoRefresh() {
+	if refresh.cancel != nil {
+		refresh.cancel()
+		refresh.cancel = nil
+	}
+	cancelSync()
+}
+
+func cancelSync() {
+	if refresh.sync != nil {
+		refresh.sync.Cancel()
+		refresh.sync = nil
+	}
+}
+
+// syncEmailList fetches the first page of the list again and merges it in.
+// It does nothing while a page is loading or a change is waiting to be sent,
+// and drops the page if the list or the service changed while it was
+// fetched, as the page would not show that.
+func syncEmailList(emailList *messageTable) {
+	if refresh.sync != nil || emailList.load != nil || hasPendingChanges() {
+		return
+	}
+	service := ui.Client.ActiveService
+	filter := emailList.filter
+	queued := writeCount
+
+	refresh.sync = runTask("Checking for new mail", func(ctx context.Context) (page, error) {
+		pendingWrites.Wait()
+		return fetchPage(ctx, service, "", filter)
+	}, func(p page, err error) {
+		refresh.sync = nil
+		if err != nil {
+			log.Printf("Unable to refresh messages: %v", err)
+			flashStatus(fmt.Sprintf("Unable to refresh messages: %v", err))
+			return
+		}
+		if service != ui.Client.ActiveService || filter != emailList.filter ||
+			queued != writeCount || hasPendingChanges() {
+			return
+		}
+		if emailList.Merge(p.summaries, p.cursor == "") {
+			updateListTitle(emailList)
+		}
+	})
+}
@@ -0,0 +1,99 @@
+package ui
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/rivo/tview"
+)
+
+// appRunning is set just before the event loop starts and cleared when it
+// stops; updates queued in between are run once it starts. Before that the
+// sign-in address is printed on the terminal instead, since a queued update
+// would wait for a loop that is not running yet.
+var appRunning atomic.Bool
+
+// showAuthURL shows the address to sign in at until done is called. Cancel
+// gives up on the sign-in.
+func showAuthURL(url string, cancel func()) (done func()) {
+	if !appRunning.Load() {
+		fmt.Fprintf(os.Stderr, "Sign in at the following address in your browser:\n%s\n\n", url)
+		return func() {}
+	}
+
+	ui.App.QueueUpdateDraw(func() {
+		modal := tview.NewModal().
+			SetText("Sign in at\n\n" + url + "\n\nMailTerm is waiting for the browser.").
+			AddButtons([]string{"Open in browser", "Copy", "Cancel"}).
+			SetDoneFunc(func(buttonIndex int, buttonLabel string) {
+				switch buttonLabel {
+				case "Open in browser":
+					if err := openURL(url); err != nil {
+						flashStatus(err.Error())
+					}
+				case "Copy":
+					if err := copyText(url); err != nil {
+						flashStatus(err.Error())
+						return
+					}
+					flashStatus("Copied the sign-in address.")
+				default:
+					cancel()
+				}
+			})
+		popupFocus["sign-in"] = ui.App.GetFocus()
+		pages.AddPage("sign-in", modal, false, true)
+		ui.App.SetFocus(modal)
+	})
+	return func() {
+		ui.App.QueueUpdateDraw(func() { hidePopup("sign-in") })
+	}
+}
+
+// reauthSnooze is how long the user is not asked again to sign in to an
+// account after putting it off.
+const reauthSnooze = 10 * time.Minute
+
+// reauth tracks the accounts the user is being asked to sign in to again,
+// is signing in to, or put off until a time. It is only touched on the
+// event goroutine.
+var reauth = map[string]time.Time{}
+
+// reauthRequired tells the user that the sign-in of an account has stopped
+// working and offers to sign in again.
+func reauthRequired(account string, signIn func() error) {
+	ui.App.QueueUpdateDraw(func() {
+		if until, ok := reauth[account]; ok && (until.IsZero() || time.Now().Before(until)) {
+			return
+		}
+		reauth[account] = time.Time{}
+		page := "reauth-" + account
+		modal := tview.NewModal().
+			SetText(fmt.Sprintf("Re-authentication required.\n\nThe %s sign-in has expired or was revoked. Sign in again to keep using the account.", account)).
+			AddButtons([]string{"Sign in", "Later"}).
+			SetDoneFunc(func(buttonIndex int, buttonLabel string) {
+				hidePopup(page)
+				if buttonLabel != "Sign in" {
+					reauth[account] = time.Now().Add(reauthSnooze)
+					flashStatus(fmt.Sprintf("%s: re-authentication required.", account))
+					return
+				}
+				runTask("Signing in to "+account, func(ctx context.Context) (struct{}, error) {
+					return struct{}{}, signIn()
+				}, func(_ struct{}, err error) {
+					delete(reauth, account)
+					if err != nil {
+						showNotice(fmt.Sprintf("Signing in to %s failed: %v", account, err))
+						return
+					}
+					flashStatus(fmt.Sprintf("Signed in to %s.", account))
+				})
+			})
+		popupFocus[page] = ui.App.GetFocus()
+		pages.AddPage(page, modal, false, true)
+		ui.App.SetFocus(modal)
+	})
+}
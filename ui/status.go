@@ -0,0 +1,137 @@
+package ui
+
+import (
+	"cartsu/mailterm/api"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	flashDuration = 4 * time.Second
+	spinnerPeriod = 100 * time.Millisecond
+)
+
+var spinnerFrames = []rune("⠋⠙⠹⠸⠼⠴⠦⠧⠇⠏")
+
+// status is what the status bar shows: the key hints, or a message flashed
+// over them for a while, after a spinner and the labels of the running
+// tasks and, on IMAP, the connection if it is down. It is only touched on
+// the event goroutine.
+var status struct {
+	hints    string
+	flash    string
+	flashSeq int
+	frame    int
+	stop     chan struct{}
+	imap     api.ConnStatus
+}
+
+// setStatusHints replaces the key hints of the status bar.
+func setStatusHints(text string) {
+	status.hints = text
+	drawStatus()
+}
+
+// flashStatus shows text in the status bar for a few seconds.
+func flashStatus(text string) {
+	status.flash = text
+	status.flashSeq++
+	seq := status.flashSeq
+	drawStatus()
+
+	time.AfterFunc(flashDuration, func() {
+		ui.App.QueueUpdateDraw(func() {
+			if seq != status.flashSeq {
+				return
+			}
+			status.flash = ""
+			drawStatus()
+		})
+	})
+}
+
+func drawStatus() {
+	text := status.hints
+	if status.flash != "" {
+		text = status.flash
+	}
+	if line := connLine(); line != "" {
+		text = line + " | " + text
+	}
+	if len(tasks) > 0 {
+		var labels []string
+		for _, t := range tasks {
+			if !slices.Contains(labels, t.label) {
+				labels = append(labels, t.label)
+			}
+		}
+		frame := spinnerFrames[status.frame%len(spinnerFrames)]
+		text = fmt.Sprintf("%c %s… | %s", frame, strings.Join(labels, ", "), text)
+	}
+	statusBar.SetText(text)
+}
+
+// connLine describes the IMAP connection while it is down, if IMAP is the
+// active service.
+func connLine() string {
+	if ui.Client == nil || ui.Client.ActiveService != "imap" {
+		return ""
+	}
+	switch s := status.imap; s.State {
+	case api.Disconnected:
+		line := "IMAP disconnected"
+		if s.Err != nil {
+			line += fmt.Sprintf(" (%v)", s.Err)
+		}
+		return fmt.Sprintf("%s, retrying in %s", line, s.Retry)
+	case api.Reconnecting:
+		return "Reconnecting to IMAP…"
+	}
+	return ""
+}
+
+// watchIMAP shows the state of the IMAP connection in the status bar.
+func watchIMAP(client *api.IMAP) {
+	client.OnStatusChange(func(s api.ConnStatus) {
+		ui.App.QueueUpdateDraw(func() {
+			wasDown := status.imap.State != api.Connected
+			status.imap = s
+			if wasDown && s.State == api.Connected && ui.Client.ActiveService == "imap" {
+				flashStatus("Reconnected to IMAP.")
+				return
+			}
+			drawStatus()
+		})
+	})
+}
+
+// startSpinner turns the spinner until stopSpinner is called. It only redraws
+// while tasks are running.
+func startSpinner() {
+	stop := make(chan struct{})
+	status.stop = stop
+	go func() {
+		ticker := time.NewTicker(spinnerPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				ui.App.QueueUpdateDraw(func() {
+					status.frame++
+					drawStatus()
+				})
+			}
+		}
+	}()
+}
+
+func stopSpinner() {
+	if status.stop != nil {
+		close(status.stop)
+		status.stop = nil
+	}
+}
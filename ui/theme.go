@@ -0,0 +1,412 @@
+package ui
+
+import (
+	"cartsu/mailterm/api"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+)
+
+// builtinThemes come with mailterm. User themes may name any of them as
+// their base.
+var builtinThemes = []api.ThemeConfig{
+	{
+		Name:          "default",
+		Background:    "black",
+		Text:          "ivory",
+		Secondary:     "gray",
+		Label:         "yellow",
+		Border:        "white",
+		Title:         "white",
+		Header:        "black",
+		HeaderText:    "white",
+		StatusBar:     "black",
+		StatusText:    "white",
+		Unread:        "ivory",
+		Read:          "silver",
+		Tagged:        "navy",
+		Selected:      "ivory",
+		SelectedText:  "black",
+		Input:         "blue",
+		InputText:     "white",
+		Button:        "blue",
+		ButtonText:    "white",
+		Heading:       "yellow",
+		MessageHeader: "teal",
+		Quote:         []string{"green", "teal", "olive"},
+		Error:         "red",
+	},
+	{
+		Name:          "light",
+		Background:    "white",
+		Text:          "black",
+		Secondary:     "gray",
+		Label:         "navy",
+		Border:        "gray",
+		Title:         "black",
+		Header:        "lightgray",
+		HeaderText:    "black",
+		StatusBar:     "lightgray",
+		StatusText:    "black",
+		Unread:        "black",
+		Read:          "dimgray",
+		Tagged:        "lightblue",
+		Selected:      "navy",
+		SelectedText:  "white",
+		Input:         "lightgray",
+		InputText:     "black",
+		Button:        "navy",
+		ButtonText:    "white",
+		Heading:       "navy",
+		MessageHeader: "purple",
+		Quote:         []string{"teal", "green", "olive"},
+		Error:         "red",
+	},
+	{
+		Name:          "high-contrast",
+		Background:    "black",
+		Text:          "white",
+		Secondary:     "white",
+		Label:         "yellow",
+		Border:        "white",
+		Title:         "yellow",
+		Header:        "white",
+		HeaderText:    "black",
+		StatusBar:     "white",
+		StatusText:    "black",
+		Unread:        "yellow",
+		Read:          "white",
+		Tagged:        "blue",
+		Selected:      "yellow",
+		SelectedText:  "black",
+		Input:         "white",
+		InputText:     "black",
+		Button:        "yellow",
+		ButtonText:    "black",
+		Heading:       "yellow",
+		MessageHeader: "aqua",
+		Quote:         []string{"aqua", "lime", "fuchsia"},
+		Error:         "red",
+	},
+	{
+		// only the 16 colors every terminal has, shown in its own palette
+		Name:          "16-color",
+		Background:    "default",
+		Text:          "default",
+		Secondary:     "silver",
+		Label:         "yellow",
+		Border:        "silver",
+		Title:         "white",
+		Header:        "navy",
+		HeaderText:    "white",
+		StatusBar:     "navy",
+		StatusText:    "white",
+		Unread:        "white",
+		Read:          "silver",
+		Tagged:        "blue",
+		Selected:      "teal",
+		SelectedText:  "white",
+		Input:         "navy",
+		InputText:     "white",
+		Button:        "blue",
+		ButtonText:    "white",
+		Heading:       "yellow",
+		MessageHeader: "aqua",
+		Quote:         []string{"green", "teal", "olive"},
+		Error:         "red",
+	},
+}
+
+// theme is a resolved theme.
+type theme struct {
+	name string
+
+	background, text, secondary, label, border, title tcell.Color
+	header, headerText, statusBar, statusText         tcell.Color
+	unread, read, tagged, selected, selectedText      tcell.Color
+	input, inputText, button, buttonText              tcell.Color
+
+	// colors used in dynamic color tags
+	heading, messageHeader, errorTag string
+	quote                            []string
+}
+
+// currentTheme is the active theme. Widgets created later read it directly;
+// existing ones are restyled through themeHooks.
+var currentTheme *theme
+
+var themeHooks []func(t *theme)
+
+// userThemes are the themes loaded from MAILTERM_HOME/themes.
+var userThemes []api.ThemeConfig
+
+// onTheme styles a widget with the current theme now and whenever the theme
+// changes.
+func onTheme(style func(t *theme)) {
+	themeHooks = append(themeHooks, style)
+	style(currentTheme)
+}
+
+// themeNames lists the built-in themes followed by the user themes.
+func themeNames() []string {
+	var names []string
+	for _, t := range builtinThemes {
+		names = append(names, t.Name)
+	}
+	for _, t := range userThemes {
+		names = append(names, t.Name)
+	}
+	return names
+}
+
+// findTheme looks a theme up by name, user themes first so that they can
+// replace a built-in one.
+func findTheme(name string) (api.ThemeConfig, bool) {
+	for _, t := range userThemes {
+		if t.Name == name {
+			return t, true
+		}
+	}
+	for _, t := range builtinThemes {
+		if t.Name == name {
+			return t, true
+		}
+	}
+	return api.ThemeConfig{}, false
+}
+
+// resolveTheme fills in the fields a theme leaves empty from its base
+// themes and parses the colors.
+func resolveTheme(name string) (*theme, error) {
+	config, ok := findTheme(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown theme %q", name)
+	}
+
+	// built-in themes are complete; user themes inherit until they reach one
+	builtin := !isUserTheme(name)
+	seen := map[string]bool{name: true}
+	for !builtin {
+		base := config.Base
+		if base == "" {
+			base = "default"
+		}
+
+		var parent api.ThemeConfig
+		if base == config.Name {
+			// a user theme extending the built-in theme it replaces
+			parent, ok = builtinTheme(base)
+			builtin = true
+		} else {
+			if seen[base] {
+				return nil, fmt.Errorf("theme %q: base themes form a loop at %q", name, base)
+			}
+			seen[base] = true
+			parent, ok = findTheme(base)
+			builtin = !isUserTheme(base)
+		}
+		if !ok {
+			return nil, fmt.Errorf("theme %q: unknown base theme %q", name, base)
+		}
+		config = inheritTheme(config, parent)
+	}
+
+	t := &theme{name: name}
+	var problems []string
+	color := func(field, value string) tcell.Color {
+		if value == "default" {
+			return tcell.ColorDefault
+		}
+		c := tcell.GetColor(value)
+		if c == tcell.ColorDefault {
+			problems = append(problems, fmt.Sprintf("%s: unknown color %q", field, value))
+		}
+		return c
+	}
+	tag := func(field, value string) string {
+		if value == "default" {
+			return "-"
+		}
+		color(field, value)
+		return value
+	}
+
+	t.background = color("background", config.Background)
+	t.text = color("text", config.Text)
+	t.secondary = color("secondary", config.Secondary)
+	t.label = color("label", config.Label)
+	t.border = color("border", config.Border)
+	t.title = color("title", config.Title)
+	t.header = color("header", config.Header)
+	t.headerText = color("header_text", config.HeaderText)
+	t.statusBar = color("status_bar", config.StatusBar)
+	t.statusText = color("status_text", config.StatusText)
+	t.unread = color("unread", config.Unread)
+	t.read = color("read", config.Read)
+	t.tagged = color("tagged", config.Tagged)
+	t.selected = color("selected", config.Selected)
+	t.selectedText = color("selected_text", config.SelectedText)
+	t.input = color("input", config.Input)
+	t.inputText = color("input_text", config.InputText)
+	t.button = color("button", config.Button)
+	t.buttonText = color("button_text", config.ButtonText)
+	t.heading = tag("heading", config.Heading)
+	t.messageHeader = tag("message_header", config.MessageHeader)
+	t.errorTag = tag("error", config.Error)
+	for _, q := range config.Quote {
+		t.quote = append(t.quote, tag("quote", q))
+	}
+
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("theme %q: %s", name, strings.Join(problems, ", "))
+	}
+	return t, nil
+}
+
+func isUserTheme(name string) bool {
+	for _, t := range userThemes {
+		if t.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func builtinTheme(name string) (api.ThemeConfig, bool) {
+	for _, t := range builtinThemes {
+		if t.Name == name {
+			return t, true
+		}
+	}
+	return api.ThemeConfig{}, false
+}
+
+// inheritTheme fills the empty fields of t from parent and continues the
+// chain with the parent's base.
+func inheritTheme(t, parent api.ThemeConfig) api.ThemeConfig {
+	fields := []struct{ child, base *string }{
+		{&t.Background, &parent.Background},
+		{&t.Text, &parent.Text},
+		{&t.Secondary, &parent.Secondary},
+		{&t.Label, &parent.Label},
+		{&t.Border, &parent.Border},
+		{&t.Title, &parent.Title},
+		{&t.Header, &parent.Header},
+		{&t.HeaderText, &parent.HeaderText},
+		{&t.StatusBar, &parent.StatusBar},
+		{&t.StatusText, &parent.StatusText},
+		{&t.Unread, &parent.Unread},
+		{&t.Read, &parent.Read},
+		{&t.Tagged, &parent.Tagged},
+		{&t.Selected, &parent.Selected},
+		{&t.SelectedText, &parent.SelectedText},
+		{&t.Input, &parent.Input},
+		{&t.InputText, &parent.InputText},
+		{&t.Button, &parent.Button},
+		{&t.ButtonText, &parent.ButtonText},
+		{&t.Heading, &parent.Heading},
+		{&t.MessageHeader, &parent.MessageHeader},
+		{&t.Error, &parent.Error},
+	}
+	for _, f := range fields {
+		if *f.child == "" {
+			*f.child = *f.base
+		}
+	}
+	if len(t.Quote) == 0 {
+		t.Quote = parent.Quote
+	}
+	t.Name = parent.Name
+	t.Base = parent.Base
+	return t
+}
+
+// applyTheme makes a theme current and restyles every widget with it.
+func applyTheme(name string) error {
+	t, err := resolveTheme(name)
+	if err != nil {
+		return err
+	}
+	currentTheme = t
+
+	tview.Styles = tview.Theme{
+		PrimitiveBackgroundColor:    t.background,
+		ContrastBackgroundColor:     t.input,
+		MoreContrastBackgroundColor: t.button,
+		BorderColor:                 t.border,
+		TitleColor:                  t.title,
+		GraphicsColor:               t.border,
+		PrimaryTextColor:            t.text,
+		SecondaryTextColor:          t.label,
+		TertiaryTextColor:           t.secondary,
+		InverseTextColor:            t.buttonText,
+		ContrastSecondaryTextColor:  t.inputText,
+	}
+	api.HeadingColor = t.heading
+	api.MessageHeaderColor = t.messageHeader
+
+	for _, style := range themeHooks {
+		style(t)
+	}
+	return nil
+}
+
+// loadTheme loads the user themes and applies the configured theme, falling
+// back to the default one.
+func loadTheme() error {
+	var loadErr error
+	userThemes, loadErr = api.LoadThemes()
+
+	name := ui.Config.UI.Theme
+	if name == "" {
+		name = "default"
+	}
+	if err := applyTheme(name); err != nil {
+		_ = applyTheme("default")
+		return err
+	}
+	return loadErr
+}
+
+// styleBox colors the background, border and title of a widget.
+func styleBox(box *tview.Box, t *theme) {
+	box.SetBackgroundColor(t.background).
+		SetBorderColor(t.border).
+		SetTitleColor(t.title)
+}
+
+// newList creates a popup list in the colors of the current theme.
+func newList() *tview.List {
+	t := currentTheme
+	list := tview.NewList().
+		SetMainTextColor(t.text).
+		SetSecondaryTextColor(t.secondary).
+		SetShortcutColor(t.label).
+		SetSelectedTextColor(t.selectedText).
+		SetSelectedBackgroundColor(t.selected)
+	styleBox(list.Box, t)
+	return list
+}
+
+var quotePrefix = regexp.MustCompile(`^(?:> ?)+`)
+
+// colorQuotes colors quoted lines by how deeply they are quoted.
+func colorQuotes(text string) string {
+	if len(currentTheme.quote) == 0 {
+		return text
+	}
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		prefix := quotePrefix.FindString(line)
+		if prefix == "" {
+			continue
+		}
+		depth := strings.Count(prefix, ">")
+		color := currentTheme.quote[(depth-1)%len(currentTheme.quote)]
+		lines[i] = "[" + color + "]" + line + "[-]"
+	}
+	return strings.Join(lines, "\n")
+}
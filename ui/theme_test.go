@@ -0,0 +1,113 @@
+package ui
+
+import (
+	"cartsu/mailterm/api"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+func TestResolveTheme(t *testing.T) {
+	saved := userThemes
+	defer func() { userThemes = saved }()
+	userThemes = []api.ThemeConfig{
+		{Name: "dusk", Text: "orange"},
+		{Name: "dusk-light", Base: "dusk", Background: "white", Quote: []string{"purple"}},
+		{Name: "paper", Base: "light", Unread: "#102030"},
+		{Name: "light", Base: "light", Border: "black"},
+		{Name: "terminal", Base: "16-color", Read: "default"},
+		{Name: "loop-a", Base: "loop-b"},
+		{Name: "loop-b", Base: "loop-a"},
+		{Name: "orphan", Base: "missing"},
+		{Name: "typo", Text: "bleu", Heading: "grene"},
+	}
+
+	tests := []struct {
+		name  string
+		check func(t *testing.T, th *theme)
+		err   string
+	}{
+		{
+			name: "default",
+			check: func(t *testing.T, th *theme) {
+				expectColor(t, "text", th.text, tcell.GetColor("ivory"))
+			},
+		},
+		{
+			name: "dusk",
+			check: func(t *testing.T, th *theme) {
+				expectColor(t, "text", th.text, tcell.GetColor("orange"))
+				expectColor(t, "background", th.background, tcell.GetColor("black"))
+			},
+		},
+		{
+			name: "dusk-light",
+			check: func(t *testing.T, th *theme) {
+				expectColor(t, "background", th.background, tcell.GetColor("white"))
+				expectColor(t, "text", th.text, tcell.GetColor("orange"))
+				expectColor(t, "label", th.label, tcell.GetColor("yellow"))
+				if !reflect.DeepEqual(th.quote, []string{"purple"}) {
+					t.Errorf("quote = %q, want [purple]", th.quote)
+				}
+			},
+		},
+		{
+			name: "paper",
+			check: func(t *testing.T, th *theme) {
+				expectColor(t, "unread", th.unread, tcell.NewHexColor(0x102030))
+				// the user theme replacing "light" is the base, not the built-in one
+				expectColor(t, "border", th.border, tcell.GetColor("black"))
+				expectColor(t, "text", th.text, tcell.GetColor("black"))
+				if !reflect.DeepEqual(th.quote, []string{"teal", "green", "olive"}) {
+					t.Errorf("quote = %q, want light's", th.quote)
+				}
+			},
+		},
+		{
+			name: "light",
+			check: func(t *testing.T, th *theme) {
+				expectColor(t, "border", th.border, tcell.GetColor("black"))
+				expectColor(t, "background", th.background, tcell.GetColor("white"))
+			},
+		},
+		{
+			name: "terminal",
+			check: func(t *testing.T, th *theme) {
+				expectColor(t, "read", th.read, tcell.ColorDefault)
+				expectColor(t, "background", th.background, tcell.ColorDefault)
+				if th.heading != "yellow" {
+					t.Errorf("heading = %q, want yellow", th.heading)
+				}
+			},
+		},
+		{name: "loop-a", err: `base themes form a loop`},
+		{name: "orphan", err: `unknown base theme "missing"`},
+		{name: "typo", err: `text: unknown color "bleu", heading: unknown color "grene"`},
+		{name: "nonexistent", err: `unknown theme "nonexistent"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			th, err := resolveTheme(tt.name)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("resolveTheme(%q) error = %v, want one containing %q", tt.name, err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, th)
+		})
+	}
+}
+
+func expectColor(t *testing.T, field string, got, want tcell.Color) {
+	t.Helper()
+	if got != want {
+		t.Errorf("%s = %v, want %v", field, got, want)
+	}
+}
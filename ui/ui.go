@@ -3,41 +3,56 @@ package ui
 import (
 	"cartsu/mailterm/api"
 	"context"
+	"errors"
 	"fmt"
+	"io/fs"
 	"log"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
-	"github.com/emersion/go-imap"
 	"github.com/gdamore/tcell/v2"
-	graphmodels "github.com/microsoftgraph/msgraph-sdk-go/models"
 	"github.com/rivo/tview"
-	"google.golang.org/api/gmail/v1"
 )
 
+// RefreshPeriod is how often auto-refresh syncs the list unless the config
+// sets a refresh interval.
+const RefreshPeriod = 10 * time.Second
+
 const (
-	KeyQuit       = 'q'
-	KeyReply      = 'r'
-	KeyForward    = 'f'
-	KeyDelete     = 'd'
-	KeyNew        = 'n'
-	KeySettings   = tcell.KeyTab
-	RefreshPeriod = 10 * time.Second
+	pageSize     = 25
+	prefetchRows = 5 // load the next page when the cursor gets this close to the end
 )
 
 var settingsVisible = false
 
 var ui InterfaceConfig
 
+// pages holds the main layout with popups stacked on top of it.
+var pages *tview.Pages
+
+var statusBar *tview.TextView
+
+// contentFlex holds the message list and the message pane side by side.
+var contentFlex *tview.Flex
+
+// shownMessageId is the message in the message pane.
+var shownMessageId string
+
 type InterfaceConfig struct {
 	App         *tview.Application
 	Client      *api.EmailClient
+	Config      *api.Config
 	BaseDir     string
 	AutoRefresh bool
 }
 
 func InitializeInterface(uiConf InterfaceConfig) error {
 	ui = uiConf
+	api.VaultPassphrase = askPassphrase
+	api.ShowAuthURL = showAuthURL
+	api.ReauthRequired = reauthRequired
 
 	var emailClient *api.EmailClient
 	var err error
@@ -58,137 +73,264 @@ func InitializeInterface(uiConf InterfaceConfig) error {
 		}
 	}
 
+	config, err := api.LoadConfig()
+	if err != nil {
+		config = &api.Config{}
+	}
+	configErr := config.UI.Sanitize()
+	autoRefresh := ui.AutoRefresh
+	if config.UI.AutoRefresh != nil {
+		autoRefresh = *config.UI.AutoRefresh
+	}
+
 	ui = InterfaceConfig{
 		App:         ui.App,
 		Client:      emailClient,
-		AutoRefresh: ui.AutoRefresh,
+		Config:      config,
+		BaseDir:     ui.BaseDir,
+		AutoRefresh: autoRefresh,
+	}
+
+	if ui.Client.IMAP != nil {
+		watchIMAP(ui.Client.IMAP)
 	}
 
+	keysErr := loadKeyMaps()
+	themeErr := loadTheme()
+
 	header := createHeader()
-	statusBar := createFooter()
+	statusBar = createFooter()
 	emailList := createEmailList()
 	messageBody := createMessageBody()
-	settingsPane := createSettingsPane(emailList, statusBar)
+	settingsPane := createSettingsPane(emailList)
 
-	settingsPane.AddButton("Save", nil)
+	settingsPane.AddButton("Save", saveSettings)
 	settingsPane.SetBorder(true)
 	settingsPane.SetTitle("Settings")
 	settingsPane.SetBorderAttributes(tcell.AttrDim)
+	onTheme(func(t *theme) {
+		styleBox(settingsPane.Box, t)
+		settingsPane.SetLabelColor(t.label).
+			SetFieldBackgroundColor(t.input).
+			SetFieldTextColor(t.inputText).
+			SetButtonBackgroundColor(t.button).
+			SetButtonTextColor(t.buttonText)
+	})
 
 	leftPanel := createLeftPanel(emailList)
 	rightPanel := createRightPanel(messageBody)
-	contentFlex := tview.NewFlex().
-		AddItem(leftPanel, 0, 2, true).
-		AddItem(rightPanel, 0, 5, false)
+	listWidth := listWidth()
+	contentFlex = tview.NewFlex().
+		AddItem(leftPanel, 0, listWidth, true).
+		AddItem(rightPanel, 0, 100-listWidth, false)
+	onTheme(func(t *theme) { styleBox(contentFlex.Box, t) })
 
 	mainFlex := tview.NewFlex().
 		AddItem(contentFlex, 0, 1, true)
+	onTheme(func(t *theme) { styleBox(mainFlex.Box, t) })
 
 	rootFlex := tview.NewFlex().
 		SetDirection(tview.FlexRow).
 		AddItem(header, 1, 0, false).
 		AddItem(mainFlex, 0, 1, true).
 		AddItem(statusBar, 1, 0, false)
+	onTheme(func(t *theme) { styleBox(rootFlex.Box, t) })
+
+	pages = tview.NewPages().
+		AddPage("main", rootFlex, true, true)
 
-	setupKeyBindings(emailList, messageBody, settingsPane, mainFlex, rootFlex)
+	setupKeyBindings(emailList, messageBody, settingsPane, mainFlex, pages)
 	setupEvents(emailList, messageBody)
 
 	populateEmailList(emailList)
+	if ui.AutoRefresh {
+		startAutoRefresh(emailList)
+	}
+	startOutbox()
+	if configErr != nil {
+		showNotice(fmt.Sprintf("Some settings in config.json are invalid and were reset:\n\n%v", configErr))
+	}
+	if keysErr != nil {
+		showNotice(fmt.Sprintf("%v\n\nUsing the default keys.", keysErr))
+	}
+	if themeErr != nil {
+		showNotice(fmt.Sprintf("%v\n\nUsing the %s theme.", themeErr, currentTheme.name))
+	}
 
-	// redraw the screen every half second
-	go func() {
-		for {
-			time.Sleep(time.Second / 2)
-			ui.App.Draw()
-		}
-	}()
-
-	return ui.App.SetRoot(rootFlex, true).Run()
+	appRunning.Store(true)
+	defer appRunning.Store(false)
+	return ui.App.SetRoot(pages, true).Run()
 }
 
 func createHeader() *tview.TextView {
-	return tview.NewTextView().
+	header := tview.NewTextView().
 		SetTextAlign(tview.AlignCenter).
 		SetText("MailTerm-Go")
+	onTheme(func(t *theme) {
+		header.SetTextColor(t.headerText).SetBackgroundColor(t.header)
+	})
+	return header
 }
 
 func createFooter() *tview.TextView {
 	statusbar := tview.NewTextView().
 		SetTextAlign(tview.AlignLeft)
 
-	switch ui.Client.ActiveService {
-	case "graph", "gmail":
-		statusbar.SetText("'q' quit | 'n' new | 'r' reply | 'f' forward | 'd' delete | 'tab' settings")
-	case "imap":
-		statusbar.SetText("'q' quit |'d' delete | 'tab' settings")
-	}
+	status.hints = statusText(ui.Client.ActiveService)
+	statusbar.SetText(status.hints)
+	onTheme(func(t *theme) {
+		statusbar.SetTextColor(t.statusText).SetBackgroundColor(t.statusBar)
+	})
 	return statusbar
 }
 
-func createEmailList() *tview.List {
-	return tview.NewList().
-		SetSecondaryTextColor(tcell.ColorGray).
-		SetMainTextColor(tcell.ColorIvory).
-		SetWrapAround(true).
-		ShowSecondaryText(false)
+func createEmailList() *messageTable {
+	return newMessageTable(ui.Config.UI.Columns)
 }
 
 func createMessageBody() *tview.TextView {
-	return tview.NewTextView().
+	messageBody := tview.NewTextView().
 		SetDynamicColors(true).
 		SetRegions(true).
 		SetWordWrap(true).
 		SetScrollable(true)
+	onTheme(func(t *theme) {
+		messageBody.SetTextColor(t.text).SetBackgroundColor(t.background)
+	})
+	return messageBody
 }
 
-func createSettingsPane(emailList *tview.List, statusbar *tview.TextView) *tview.Form {
+func createSettingsPane(emailList *messageTable) *tview.Form {
 	var initialized = false
 	form := tview.NewForm().
-		AddDropDown("Email Service", []string{"Gmail", "Microsoft Graph", "IMAP"}, 0, func(option string, index int) {
+		AddDropDown("Email Service", []string{"Gmail", "Microsoft Graph", "IMAP"}, max(slices.Index(accounts, ui.Client.ActiveService), 0), func(option string, index int) {
 			if !initialized {
 				initialized = true
 				return
 			}
+			// pending actions belong to the service being left
+			forgetListActions()
 
 			switch option {
 			case "Gmail":
 				if !configExists("gmail") {
-					showWarning(ui.App, `Configuration file not found. Please set up your config.json file.`)
+					showNotice(`Configuration file not found. Please set up your config.json file.`)
 					return
 				}
 				ui.Client.SwitchToGmail()
-				emailList.Clear()
-				statusbar.SetText("'q' quit | 'n' new | 'r' reply | 'f' forward | 'd' delete | 'tab' settings")
-				populateEmailList(emailList)
+				showAccount(emailList)
 			case "Microsoft Graph":
 				if !configExists("graph") {
-					showWarning(ui.App, `Configuration file not found. Please set up your config.json file.`)
+					showNotice(`Configuration file not found. Please set up your config.json file.`)
 					return
 				}
 				ui.Client.SwitchToGraph()
-				emailList.Clear()
-				statusbar.SetText("'q' quit | 'n' new | 'r' reply | 'f' forward | 'd' delete | 'tab' settings")
-				populateEmailList(emailList)
+				showAccount(emailList)
 			case "IMAP":
 				ui.Client.SwitchToIMAP()
-				emailList.Clear()
-				statusbar.SetText("'q' quit |'d' delete | 'tab' settings")
-				populateEmailList(emailList)
+				showAccount(emailList)
 			}
 
 		}).
-		AddDropDown("Themes", []string{"coming", "soon"}, 0, nil).
-		AddCheckbox("Auto-refresh", false, func(checked bool) {
-			toggleAutoRefresh(checked)
+		AddDropDown("Theme", themeNames(), slices.Index(themeNames(), currentTheme.name), func(option string, index int) {
+			if option == "" || option == currentTheme.name {
+				return
+			}
+			if err := applyTheme(option); err != nil {
+				showNotice(err.Error())
+				return
+			}
+			ui.Config.UI.Theme = option
+		}).
+		AddCheckbox("Auto-refresh", ui.AutoRefresh, func(checked bool) {
+			ui.AutoRefresh = checked
+			if checked {
+				startAutoRefresh(emailList)
+			} else {
+				stopAutoRefresh()
+			}
+		}).
+		AddInputField("Refresh every (s)", strconv.Itoa(int(refreshInterval()/time.Second)), 5, tview.InputFieldInteger, func(text string) {
+			seconds, err := strconv.Atoi(text)
+			if err != nil || seconds <= 0 {
+				return
+			}
+			ui.Config.UI.RefreshInterval = seconds
+			if ui.AutoRefresh {
+				startAutoRefresh(emailList)
+			}
+		}).
+		AddInputField("List width (%)", strconv.Itoa(listWidth()), 5, tview.InputFieldInteger, func(text string) {
+			percent, err := strconv.Atoi(text)
+			if err != nil || percent < api.MinListWidth || percent > api.MaxListWidth {
+				return
+			}
+			ui.Config.UI.ListWidth = percent
+			contentFlex.ResizeItem(contentFlex.GetItem(0), 0, percent)
+			contentFlex.ResizeItem(contentFlex.GetItem(1), 0, 100-percent)
+		}).
+		AddDropDown("Mark read", markReadPolicies, max(slices.Index(markReadPolicies, ui.Config.UI.MarkRead), 0), func(option string, index int) {
+			ui.Config.UI.MarkRead = option
 		})
 	return form
 }
 
-func createLeftPanel(emailList *tview.List) *tview.Flex {
+// markReadPolicies are the values of the mark_read setting; "" means "open".
+var markReadPolicies = []string{"open", "delay", "never"}
+
+// defaultListWidth is about the 2:5 split the panes have always had.
+const defaultListWidth = 28
+
+func listWidth() int {
+	if width := ui.Config.UI.ListWidth; width > 0 {
+		return width
+	}
+	return defaultListWidth
+}
+
+// saveSettings writes the settings to the config file. The file is read
+// again first, so that only the settings are replaced and everything else in
+// it is kept as it is on disk.
+func saveSettings() {
+	config, err := api.LoadConfig()
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			showNotice(fmt.Sprintf("Settings not saved: reading config.json: %v", err))
+			return
+		}
+		config = &api.Config{}
+	}
+
+	autoRefresh := ui.AutoRefresh
+	ui.Config.UI.AutoRefresh = &autoRefresh
+	ui.Config.SelectedService = ui.Client.ActiveService
+	config.UI = ui.Config.UI
+	config.SelectedService = ui.Config.SelectedService
+	if err := api.SaveConfig(config); err != nil {
+		showNotice(fmt.Sprintf("Settings not saved: %v", err))
+		return
+	}
+	flashStatus("Settings saved.")
+}
+
+// showAccount shows the list of the service just switched to, which the
+// sync loop follows from now on.
+func showAccount(emailList *messageTable) {
+	clearLabelFilter(emailList)
+	setStatusHints(statusText(ui.Client.ActiveService))
+	populateEmailList(emailList)
+	if ui.AutoRefresh {
+		startAutoRefresh(emailList)
+	}
+}
+
+func createLeftPanel(emailList *messageTable) *tview.Flex {
 	leftPanel := tview.NewFlex().SetDirection(tview.FlexRow)
 	leftPanel.SetBorder(true).SetTitle("Messages")
 	leftPanel.SetBorderAttributes(tcell.AttrDim)
 	leftPanel.AddItem(emailList, 0, 1, true)
+	onTheme(func(t *theme) { styleBox(leftPanel.Box, t) })
+	messagesPanel = leftPanel
 	return leftPanel
 }
 
@@ -197,79 +339,158 @@ func createRightPanel(messageBody *tview.TextView) *tview.Flex {
 	rightPanel.SetBorder(true)
 	rightPanel.SetBorderAttributes(tcell.AttrDim)
 	rightPanel.AddItem(messageBody, 0, 1, false)
+	onTheme(func(t *theme) { styleBox(rightPanel.Box, t) })
 	return rightPanel
 }
 
-func populateEmailList(emailList *tview.List) {
-	var messages interface{}
-	var err error
-
-	switch ui.Client.ActiveService {
-	case "gmail":
-		messages, err = ui.Client.GmailClient.GetThreads()
-	case "graph":
-		messages, err = ui.Client.GraphClient.GetMessages()
-	case "imap":
-		messages, err = ui.Client.IMAP.FetchMessages(25)
+// populateEmailList reloads the list from its first page. A page still
+// being loaded for the list as it was is dropped.
+func populateEmailList(emailList *messageTable) {
+	commitPending()
+	if emailList.load != nil {
+		emailList.load.Cancel()
+		emailList.load = nil
 	}
-	if err != nil {
-		log.Printf("Unable to retrieve messages: %v", err)
+	cancelSync()
+	emailList.Clear()
+	updateListTitle(emailList)
+	loadNextPage(emailList)
+}
+
+// page is one page of the message list and the cursor of the next one.
+type page struct {
+	summaries []api.MessageSummary
+	cursor    string
+}
+
+// loadNextPage loads the page after the list's cursor in the background, if
+// there is one, and appends it.
+func loadNextPage(emailList *messageTable) {
+	if emailList.exhausted || emailList.load != nil {
 		return
 	}
+	service := ui.Client.ActiveService
+	cursor := emailList.cursor
+	filter := emailList.filter
+
+	emailList.load = runTask("Loading messages", func(ctx context.Context) (page, error) {
+		// changes already made should show in what is loaded
+		pendingWrites.Wait()
+		return fetchPage(ctx, service, cursor, filter)
+	}, func(p page, err error) {
+		emailList.load = nil
+		if err != nil {
+			log.Printf("Unable to retrieve messages: %v", err)
+			flashStatus(fmt.Sprintf("Unable to retrieve messages: %v", err))
+			return
+		}
+		emailList.cursor = p.cursor
+		emailList.exhausted = p.cursor == ""
+		emailList.Append(p.summaries)
+	})
+}
 
-	switch m := messages.(type) {
-	case []*gmail.Thread:
-		for i, message := range m {
-			emailList.AddItem(message.Snippet, message.Id, rune(i), nil)
+// fetchPage fetches the page of a service's message list at cursor.
+func fetchPage(ctx context.Context, service, cursor string, filter api.ThreadFilter) (page, error) {
+	var p page
+	switch service {
+	case "gmail":
+		threads, next, err := ui.Client.GmailClient.GetThreads(ctx, cursor, pageSize, filter)
+		if err != nil {
+			return p, err
 		}
-	case graphmodels.MessageCollectionResponseable:
-		for i, message := range m.GetValue() {
-			emailList.AddItem(*message.GetSubject(), *message.GetId(), rune(i), nil)
+		p.summaries = ui.Client.GmailClient.GetThreadSummaries(ctx, threads)
+		p.cursor = next
+	case "graph":
+		messages, err := ui.Client.GraphClient.GetMessages(ctx, cursor, pageSize, filter.Query)
+		if err != nil {
+			return p, err
+		}
+		for _, message := range messages.GetValue() {
+			p.summaries = append(p.summaries, api.SummarizeGraphMessage(message))
+		}
+		if next := messages.GetOdataNextLink(); next != nil {
+			p.cursor = *next
+		}
+	case "imap":
+		before, _ := strconv.Atoi(cursor)
+		messages, err := ui.Client.IMAP.FetchMessages(pageSize, uint32(before), filter.Query)
+		if err != nil {
+			return p, err
+		}
+		for _, message := range messages {
+			p.summaries = append(p.summaries, api.SummarizeIMAPMessage(message))
 		}
-	case []*imap.Message:
-		for i, message := range m {
-			emailList.AddItem(message.Envelope.Subject, strconv.Itoa(int(message.Uid)), rune(i), nil)
+		if len(messages) == pageSize {
+			p.cursor = strconv.Itoa(int(messages[len(messages)-1].Uid))
 		}
 	}
+	return p, nil
 }
 
-func setupEvents(emailList *tview.List, messageBody *tview.TextView) {
-	emailList.SetSelectedFunc(func(i int, mainText, secondaryText string, r rune) {
-		var newContent string
-		var err error
-
-		switch ui.Client.ActiveService {
-		case "gmail":
-			newContent, err = renderGmailMessage(ui.Client.GmailClient, secondaryText)
-		case "graph":
-			newContent, err = renderGraphMessage(ui.Client.GraphClient, secondaryText)
-		case "imap":
-			uid, err := strconv.Atoi(secondaryText)
-			if err != nil {
-				return
-			}
-			newContent, err = ui.Client.IMAP.GetMessageBody(uint32(uid))
-			if err != nil {
-				return
-			}
+func setupEvents(emailList *messageTable, messageBody *tview.TextView) {
+	emailList.SetSelectionChangedFunc(func(row, column int) {
+		if row >= emailList.GetRowCount()-prefetchRows {
+			loadNextPage(emailList)
 		}
+	})
 
-		if err != nil {
-			newContent = fmt.Sprintf("Error displaying message: %v", err)
+	// bodyLoad fetches the message being opened; opening another drops it
+	var bodyLoad *task
+	emailList.SetSelectedFunc(func(row, column int) {
+		message, ok := emailList.Current()
+		if !ok {
+			return
+		}
+		messageId := message.Id
+		service := ui.Client.ActiveService
+
+		if bodyLoad != nil {
+			bodyLoad.Cancel()
 		}
 		messageBody.Clear()
-		messageBody.SetText(newContent)
-		messageBody.ScrollToBeginning()
+		shownMessageId = ""
 		ui.App.SetFocus(messageBody)
+
+		bodyLoad = runTask("Loading message", func(ctx context.Context) (string, error) {
+			return fetchMessageBody(ctx, service, messageId)
+		}, func(newContent string, err error) {
+			bodyLoad = nil
+			if err != nil {
+				newContent = fmt.Sprintf("Error displaying message: %v", err)
+			} else {
+				newContent = colorQuotes(newContent)
+				if ui.Config.Viewer.Hyperlinks {
+					newContent = linkify(newContent)
+				}
+			}
+			messageBody.SetText(newContent)
+			messageBody.ScrollToBeginning()
+			shownMessageId = messageId
+
+			if err == nil {
+				applyReadPolicy(emailList, message)
+			}
+		})
 	})
 }
 
-func renderGmailMessage(client *api.GmailClient, messageId string) (string, error) {
-	renderedMessage, err := client.GetMessageBody(messageId)
-	if err != nil {
-		return "", err
+// fetchMessageBody fetches a message of a service rendered for the message
+// pane.
+func fetchMessageBody(ctx context.Context, service, messageId string) (string, error) {
+	switch service {
+	case "gmail":
+		return ui.Client.GmailClient.GetMessageBody(ctx, messageId)
+	case "graph":
+		return renderGraphMessage(ui.Client.GraphClient, messageId)
+	case "imap":
+		uid, err := strconv.Atoi(messageId)
+		if err != nil {
+			return "", err
+		}
+		return ui.Client.IMAP.GetMessageBody(uint32(uid))
 	}
-	return renderedMessage, nil
+	return "", fmt.Errorf("unknown service %q", service)
 }
 
 func renderGraphMessage(client *api.GraphHelper, messageId string) (string, error) {
@@ -277,82 +498,126 @@ func renderGraphMessage(client *api.GraphHelper, messageId string) (string, erro
 	return "", nil
 }
 
-func setupKeyBindings(emailList *tview.List, messageBody *tview.TextView, settingsPane *tview.Form, mainFlex *tview.Flex, rootFlex *tview.Flex) {
-	emailList.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
-		switch event.Key() {
-		case KeySettings:
-			toggleSettingsPane(emailList, mainFlex, settingsPane)
-		case tcell.KeyRune:
-			switch event.Rune() {
-			case KeyNew:
-				composePage := createComposePage(rootFlex, "")
-				ui.App.SetRoot(composePage, true)
-			case KeyQuit:
-				ui.App.Stop()
-			case KeyReply:
-				_, messageId := emailList.GetItemText(emailList.GetCurrentItem())
-				composePage := createComposePage(rootFlex, messageId)
-				ui.App.SetRoot(composePage, true)
-			case KeyDelete:
-				switch ui.Client.ActiveService {
-				case "gmail":
-					_, emailId := emailList.GetItemText(emailList.GetCurrentItem())
-					if emailId != "" {
-						ui.Client.GmailClient.TrashMessage(emailId)
-					}
-				}
-
-			}
+// lookupKey looks up a key in a context. Actions that do not work on the
+// active service are ignored.
+func lookupKey(context string, event *tcell.EventKey) (string, *tcell.EventKey) {
+	action, next := keyMaps[context].handle(event)
+	if action == "" {
+		return "", next
+	}
+	for _, a := range keyActions {
+		if a.context == context && a.name == action && !actionAvailable(a, ui.Client.ActiveService) {
+			return "", nil
 		}
+	}
+	return action, next
+}
 
-		return event
+func setupKeyBindings(emailList *messageTable, messageBody *tview.TextView, settingsPane *tview.Form, mainFlex *tview.Flex, root tview.Primitive) {
+	listAction := func(action string) {
+		switch action {
+		case "settings":
+			toggleSettingsPane(emailList, mainFlex, settingsPane)
+		case "new":
+			ui.App.SetRoot(createDraftPage(root, api.Message{}), true)
+		case "quit":
+			quit()
+		case "reply":
+			replyTo(root, emailList.CurrentId())
+		case "forward":
+			forwardMessage(root, emailList, messageBody)
+		case "toggle_read":
+			toggleRead(emailList)
+		case "flag":
+			toggleFlag(emailList)
+		case "archive":
+			archiveSelected(emailList)
+		case "move":
+			moveSelected(emailList)
+		case "labels":
+			showThreadLabels(emailList)
+		case "label_browser":
+			showLabelBrowser(emailList)
+		case "delete":
+			deleteSelected(emailList)
+		case "tag":
+			toggleTag(emailList)
+		case "tag_pattern":
+			tagMatching(emailList)
+		case "tag_all":
+			tagAll(emailList)
+		case "clear_tags":
+			clearTags(emailList)
+		case "undo":
+			undo()
+		case "outbox":
+			showOutbox()
+		case "help":
+			showHelp(contextList)
+		case "command":
+			showCommandLine()
+		}
+	}
+	emailList.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		action, next := lookupKey(contextList, event)
+		listAction(action)
+		return next
 	})
 
 	settingsPane.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
-		switch event.Key() {
-		case tcell.KeyEscape:
+		action, next := lookupKey(contextSettings, event)
+		switch action {
+		case "close":
 			toggleSettingsPane(emailList, mainFlex, settingsPane)
-		case tcell.KeyDown:
+		case "next":
 			currentItem, _ := settingsPane.GetFocusedItemIndex()
 			settingsPane.SetFocus(currentItem + 1)
-		case tcell.KeyUp:
+		case "prev":
 			currentItem, _ := settingsPane.GetFocusedItemIndex()
 			settingsPane.SetFocus(currentItem - 1)
-		case tcell.KeyRune:
-			switch event.Rune() {
-			case KeyQuit:
-				ui.App.Stop()
-			}
+		case "quit":
+			quit()
 		}
-		return event
+		return next
 	})
 
-	messageBody.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
-		switch event.Key() {
-		case tcell.KeyEscape:
+	messageAction := func(action string) {
+		switch action {
+		case "back":
 			ui.App.SetFocus(emailList)
-		case KeySettings:
+		case "settings":
 			toggleSettingsPane(emailList, mainFlex, settingsPane)
-		case tcell.KeyRune:
-			switch event.Rune() {
-			case KeyQuit:
-				ui.App.Stop()
-			case KeyReply:
-				switch ui.Client.ActiveService {
-				case "graph", "gmail":
-					ui.App.SetFocus(emailList)
-					_, messageId := emailList.GetItemText(emailList.GetCurrentItem())
-					composePage := createComposePage(rootFlex, messageId)
-					ui.App.SetRoot(composePage, true)
-				}
-			}
-		default:
+		case "quit":
+			quit()
+		case "attachments":
+			messageId := emailList.CurrentId()
+			showAttachments(messageId, messageBody)
+		case "links":
+			showLinks(messageBody)
+		case "toggle_read":
+			toggleRead(emailList)
+		case "reply":
+			ui.App.SetFocus(emailList)
+			replyTo(root, emailList.CurrentId())
+		case "forward":
+			ui.App.SetFocus(emailList)
+			forwardMessage(root, emailList, messageBody)
+		case "help":
+			showHelp(contextMessage)
+		case "command":
+			showCommandLine()
 		}
-		return event
+	}
+	messageBody.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		action, next := lookupKey(contextMessage, event)
+		messageAction(action)
+		return next
 	})
+
+	commands = buildCommands(emailList, settingsPane, listAction, messageAction)
 }
 
-func toggleSettingsPane(emailList *tview.List, mainFlex *tview.Flex, settingsPane *tview.Form) {
+func toggleSettingsPane(emailList *messageTable, mainFlex *tview.Flex, settingsPane *tview.Form) {
 	if !settingsVisible && !settingsPane.HasFocus() {
 		mainFlex.AddItem(settingsPane, 0, 1, false)
 		ui.App.SetFocus(settingsPane)
@@ -364,85 +629,134 @@ func toggleSettingsPane(emailList *tview.List, mainFlex *tview.Flex, settingsPan
 
 }
 
-func createComposePage(rootFlex *tview.Flex, emailId string) *tview.Flex {
-	composePage := tview.NewFlex().SetDirection(tview.FlexRow)
-
-	var sender string
-	var subject string
-	if emailId != "" {
-		// get sender
-		sender, subject = getSenderAndSubject(emailId, ui.Client)
+// replyTo opens the compose page addressed to the sender of a message once
+// its headers are in.
+func replyTo(root tview.Primitive, emailId string) {
+	if emailId == "" {
+		return
 	}
+	service := ui.Client.ActiveService
+	runTask("Loading message", func(ctx context.Context) (api.Message, error) {
+		var draft api.Message
+		if service == "gmail" {
+			sender, subject := getSenderAndSubject(emailId, ui.Client)
+			draft.To = sender
+			if subject != "" {
+				draft.Subject = fmt.Sprintf("Re: %s", subject)
+			}
+		}
+		return draft, nil
+	}, func(draft api.Message, err error) {
+		ui.App.SetRoot(createDraftPage(root, draft), true)
+	})
+}
+
+// createDraftPage shows the compose form filled in with draft. Messages are
+// sent through the active service, held back for the send delay, or put in
+// the outbox if a time is given in the "Send at" field.
+func createDraftPage(root tview.Primitive, draft api.Message) *tview.Flex {
+	composePage := tview.NewFlex().SetDirection(tview.FlexRow)
 
 	// Set up form
 	form := tview.NewForm()
 
-	toField := tview.NewInputField().SetLabel("To: ").SetFieldWidth(40)
-	if sender != "" {
-		toField.SetText(sender)
-	}
-	ccField := tview.NewInputField().SetLabel("Cc: ").SetFieldWidth(40)
-	bccField := tview.NewInputField().SetLabel("Bcc: ").SetFieldWidth(40)
-
-	subjectField := tview.NewInputField().SetLabel("Subject: ").SetFieldWidth(40)
-	if subject != "" {
-		subjectField.SetText(fmt.Sprintf("Re: %s", subject))
-	}
+	toField := tview.NewInputField().SetLabel("To: ").SetFieldWidth(40).SetText(draft.To)
+	ccField := tview.NewInputField().SetLabel("Cc: ").SetFieldWidth(40).SetText(draft.Cc)
+	bccField := tview.NewInputField().SetLabel("Bcc: ").SetFieldWidth(40).SetText(draft.Bcc)
+	subjectField := tview.NewInputField().SetLabel("Subject: ").SetFieldWidth(40).SetText(draft.Subject)
+	sendAtField := tview.NewInputField().SetLabel("Send at: ").SetFieldWidth(40).
+		SetPlaceholder("now, or e.g. 18:30, tomorrow 9:00, +2h")
 
 	bodyField := tview.NewTextArea().
 		SetLabel("Body: ").
-		SetText("", false)
+		SetText(draft.Body, false)
 
 	form.AddFormItem(toField)
 	form.AddFormItem(ccField)
 	form.AddFormItem(bccField)
 	form.AddFormItem(subjectField)
+	form.AddFormItem(sendAtField)
 	form.AddFormItem(bodyField)
 
-	// Add buttons
-	form.AddButton("Send", func() {
-		if ui.Client.ActiveService == "gmail" {
-			var email = api.Message{
-				To:      toField.GetText(),
-				From:    "me",
-				Subject: subjectField.GetText(),
-				Body:    bodyField.GetText(),
-			}
-
-			message := ui.Client.GmailClient.PrepareMessageForSending(email)
+	send := func() {
+		email := api.Message{
+			To:       toField.GetText(),
+			Cc:       ccField.GetText(),
+			Bcc:      bccField.GetText(),
+			From:     "me",
+			Subject:  subjectField.GetText(),
+			Body:     bodyField.GetText(),
+			ThreadId: draft.ThreadId,
+		}
 
-			err := ui.Client.GmailClient.SendMessage(message)
+		if text := sendAtField.GetText(); text != "" {
+			sendAt, err := parseSendTime(text, time.Now())
 			if err != nil {
-				showWarning(ui.App, fmt.Sprintf("Error sending message: %s", err.Error()))
+				form.SetTitle("Compose Email [" + currentTheme.errorTag + "]" + tview.Escape(err.Error()))
+				form.SetFocus(form.GetFormItemIndex("Send at: "))
+				ui.App.SetFocus(form)
+				return
 			}
+			ui.App.SetRoot(root, true)
+			scheduleMessage(email, sendAt)
+			return
 		}
-		ui.App.SetRoot(rootFlex, true)
-	})
 
+		ui.App.SetRoot(root, true)
+		sendMessage(root, email)
+	}
+
+	// Add buttons
+	form.AddButton("Send", send)
 	form.AddButton("Cancel", func() {
-		ui.App.SetRoot(rootFlex, true)
+		ui.App.SetRoot(root, true)
 	})
 
 	// Set up form appearance
 	form.SetBorder(true).
-		SetTitle("Compose Email").
+		SetTitle(fmt.Sprintf("Compose Email (%s send, %s discard)", keyHint(contextCompose, "send"), keyHint(contextCompose, "cancel"))).
 		SetTitleAlign(tview.AlignLeft)
 
 	composePage.AddItem(form, 0, 1, true)
 
 	// Handle input
 	composePage.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
-		switch event.Key() {
-		case tcell.KeyEscape:
-			ui.App.SetRoot(rootFlex, true)
-			return nil
+		action, next := lookupKey(contextCompose, event)
+		switch action {
+		case "send":
+			send()
+		case "cancel":
+			ui.App.SetRoot(root, true)
 		}
-		return event
+		return next
 	})
 
 	return composePage
 }
 
+// forwardMessage opens the compose page with the selected message below a
+// forwarding header. The body is taken from the message pane if it shows
+// that message.
+func forwardMessage(root tview.Primitive, emailList *messageTable, messageBody *tview.TextView) {
+	message, ok := emailList.Current()
+	if !ok {
+		return
+	}
+
+	var body strings.Builder
+	body.WriteString("\n\n---------- Forwarded message ----------\n")
+	fmt.Fprintf(&body, "From: %s\nDate: %s\nSubject: %s\n\n", message.From, message.Date.Format(time.RFC1123Z), message.Subject)
+	if shownMessageId == message.Id {
+		body.WriteString(messageBody.GetText(true))
+	}
+
+	draft := api.Message{
+		Subject: "Fwd: " + message.Subject,
+		Body:    body.String(),
+	}
+	ui.App.SetRoot(createDraftPage(root, draft), true)
+}
+
 func getSenderAndSubject(id string, client *api.EmailClient) (string, string) {
 	var sender string
 	var subject string
@@ -462,26 +776,3 @@ func getSenderAndSubject(id string, client *api.EmailClient) (string, string) {
 	}
 	return sender, subject
 }
-
-func autoRefresh(ctx context.Context, emailList *tview.List) {
-	ticker := time.NewTicker(RefreshPeriod)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-ticker.C:
-			ui.App.QueueUpdateDraw(func() {
-				populateEmailList(emailList)
-			})
-		}
-	}
-}
-
-func toggleAutoRefresh(isAutoRefresh bool) {
-	ui.AutoRefresh = isAutoRefresh
-	if isAutoRefresh {
-		go autoRefresh(context.Background(), createEmailList())
-	}
-}
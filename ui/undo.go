@@ -0,0 +1,305 @@
+package ui
+
+import (
+	"cartsu/mailterm/api"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	defaultUndoGrace = 5 * time.Second
+	undoDepth        = 50
+)
+
+// undoEntry is an action that can be taken back. It is applied to the list at
+// once and sent to the server when its grace period is over, or earlier if
+// the list is reloaded, the service is switched or the program quits.
+// Detached entries, such as delayed sends, do not touch the list and are
+// only hurried along when the program quits.
+type undoEntry struct {
+	description string
+	grace       time.Duration // zero means the undo grace period
+	detached    bool
+	commit      func() error
+	// revert reverses a committed action on the server. It is nil if the
+	// service has no way to do that.
+	revert func() error
+	// restore takes back what the action did locally, such as putting the
+	// list back the way it was.
+	restore func()
+
+	timer     *time.Timer
+	committed bool
+}
+
+var undoStack []*undoEntry
+
+func undoGrace() time.Duration {
+	switch grace := ui.Config.UI.UndoGrace; {
+	case grace < 0:
+		return 0
+	case grace == 0:
+		return defaultUndoGrace
+	default:
+		return time.Duration(grace) * time.Second
+	}
+}
+
+// perform records an action that has been applied to the list and commits
+// it after the grace period.
+func perform(e *undoEntry) {
+	undoStack = append(undoStack, e)
+	if n := len(undoStack) - undoDepth; n > 0 {
+		// quit only sees the stack, so what falls off is committed now
+		for _, old := range undoStack[:n] {
+			commitEntry(old)
+		}
+		undoStack = slices.Delete(undoStack, 0, n)
+	}
+
+	grace := e.grace
+	if grace == 0 {
+		grace = undoGrace()
+	}
+	if grace == 0 {
+		commitEntry(e)
+		return
+	}
+	e.timer = time.AfterFunc(grace, func() {
+		ui.App.QueueUpdateDraw(func() {
+			// undone after the timer fired but before this ran
+			if !slices.Contains(undoStack, e) {
+				return
+			}
+			commitEntry(e)
+		})
+	})
+	if hint := keyHint(contextList, "undo"); hint != "" {
+		flashStatus(fmt.Sprintf("%s. Press %s to undo.", e.description, hint))
+	}
+}
+
+// commitEntry queues an action to be sent to the server. If that fails the
+// action is dropped and, if it is still on the stack and so still belongs to
+// the list shown, the list restored.
+func commitEntry(e *undoEntry) {
+	if e.committed {
+		return
+	}
+	if e.timer != nil {
+		e.timer.Stop()
+	}
+	e.committed = true
+
+	runWrite("Saving changes", e.commit, func(err error) {
+		if err != nil {
+			current := slices.Contains(undoStack, e)
+			undoStack = slices.DeleteFunc(undoStack, func(other *undoEntry) bool { return other == e })
+			showNotice(fmt.Sprintf("%s failed: %v", e.description, err))
+			if current {
+				e.restore()
+			}
+		}
+	})
+}
+
+var errCannotRevert = errors.New("cannot revert")
+
+// commitPending sends every list action that is still in its grace period.
+func commitPending() {
+	for _, e := range slices.Clone(undoStack) {
+		if !e.detached {
+			commitEntry(e)
+		}
+	}
+}
+
+// forgetListActions commits the list actions and takes them off the stack.
+// It is called when the list is about to show another account, which their
+// restores would otherwise put the old account's messages into.
+func forgetListActions() {
+	commitPending()
+	undoStack = slices.DeleteFunc(undoStack, func(e *undoEntry) bool { return !e.detached })
+}
+
+// hasPendingChanges reports whether a list action is still in its grace
+// period, so that the server does not show it yet.
+func hasPendingChanges() bool {
+	return slices.ContainsFunc(undoStack, func(e *undoEntry) bool { return !e.committed && !e.detached })
+}
+
+// undo takes back the latest action. One still in its grace period is only
+// restored in the list; a committed one is reversed on the server first. A
+// delayed send that has not gone out yet comes before anything else, so
+// that actions taken after it do not stand in the way of recalling it.
+func undo() {
+	if len(undoStack) == 0 {
+		flashStatus("Nothing to undo.")
+		return
+	}
+	i := len(undoStack) - 1
+	for j := i; j >= 0; j-- {
+		if undoStack[j].detached && !undoStack[j].committed {
+			i = j
+			break
+		}
+	}
+	e := undoStack[i]
+	undoStack = slices.Delete(undoStack, i, i+1)
+
+	if !e.committed {
+		e.timer.Stop()
+		e.restore()
+		flashStatus("Undone: " + e.description)
+		return
+	}
+
+	// the revert is queued behind the commit, which sets it for removals
+	runWrite("Undoing", func() error {
+		if e.revert == nil {
+			return errCannotRevert
+		}
+		return e.revert()
+	}, func(err error) {
+		switch {
+		case errors.Is(err, errCannotRevert):
+			showNotice(fmt.Sprintf("%s can no longer be undone on this service.", e.description))
+		case err != nil:
+			showNotice(fmt.Sprintf("Undoing %s failed: %v", strings.ToLower(e.description), err))
+		default:
+			e.restore()
+			flashStatus("Undone: " + e.description)
+		}
+	})
+}
+
+// quit sends every pending action, delayed sends included, and stops the
+// program once they are done.
+func quit() {
+	for _, e := range slices.Clone(undoStack) {
+		commitEntry(e)
+	}
+	go func() {
+		pendingWrites.Wait()
+		ui.App.Stop()
+	}()
+}
+
+// describe names an action on a number of messages, e.g. "Deleted 3 messages".
+func describe(verb string, messages []api.MessageSummary) string {
+	if len(messages) == 1 {
+		return verb + " 1 message"
+	}
+	return fmt.Sprintf("%s %d messages", verb, len(messages))
+}
+
+// removeAction takes messages out of the list and records commit as an
+// undoable action that puts them back where they were.
+func removeAction(emailList *messageTable, messages []api.MessageSummary, description string, commit func() (revert func() error, err error)) {
+	rows := make([]int, len(messages))
+	for i, message := range messages {
+		rows[i] = emailList.Index(message.Id)
+	}
+	removeMessages(emailList, messages)
+
+	e := &undoEntry{
+		description: description,
+		restore: func() {
+			// messages are in list order, so the rows are ascending
+			for i, message := range messages {
+				emailList.Insert(rows[i], message)
+			}
+			updateListTitle(emailList)
+		},
+	}
+	e.commit = func() error {
+		revert, err := commit()
+		e.revert = revert
+		return err
+	}
+	perform(e)
+}
+
+// updateAction shows messages with new details and records commit as an
+// undoable action; before holds the messages as they were.
+func updateAction(emailList *messageTable, before, after []api.MessageSummary, description string, commit, revert func() error) {
+	for _, message := range after {
+		emailList.Update(message)
+	}
+	perform(&undoEntry{
+		description: description,
+		commit:      commit,
+		revert:      revert,
+		restore: func() {
+			for _, message := range before {
+				emailList.Update(message)
+			}
+		},
+	})
+}
+
+// restoreGmailLabels returns a revert function for a label change on Gmail
+// threads: the labels that were added are removed again and those that were
+// removed are put back, as far as the threads had them before.
+func restoreGmailLabels(messages []api.MessageSummary, added, removed []string) func() error {
+	return func() error {
+		type change struct{ add, remove []string }
+		changes := make(map[string]change)
+		threads := make(map[string][]string)
+
+		for _, m := range messages {
+			var c change
+			known := len(m.Labels) > 0
+			for _, id := range removed {
+				if !known || slices.Contains(m.Labels, id) {
+					c.add = append(c.add, id)
+				}
+			}
+			for _, id := range added {
+				if !known || !slices.Contains(m.Labels, id) {
+					c.remove = append(c.remove, id)
+				}
+			}
+			if len(c.add) == 0 && len(c.remove) == 0 {
+				continue
+			}
+			key := strings.Join(c.add, ",") + "|" + strings.Join(c.remove, ",")
+			changes[key] = c
+			threads[key] = append(threads[key], m.ThreadId)
+		}
+
+		for key, c := range changes {
+			if err := ui.Client.GmailClient.ModifyThreadLabels(threads[key], c.add, c.remove); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// restoreFlags returns a revert function that sets the flags of messages
+// back to what they were.
+func restoreFlags(service string, messages []api.MessageSummary) func() error {
+	return func() error {
+		var flagged, unflagged []api.MessageSummary
+		for _, m := range messages {
+			if m.Flagged {
+				flagged = append(flagged, m)
+			} else {
+				unflagged = append(unflagged, m)
+			}
+		}
+		if len(flagged) > 0 {
+			if err := setFlagged(service, flagged, true); err != nil {
+				return err
+			}
+		}
+		if len(unflagged) > 0 {
+			return setFlagged(service, unflagged, false)
+		}
+		return nil
+	}
+}
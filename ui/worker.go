@@ -0,0 +1,144 @@
+package ui
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"slices"
+	"sync"
+)
+
+// task is an operation running in the background. Its label is shown in the
+// status bar while it runs.
+type task struct {
+	label  string
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// tasks are the running tasks. Like the widgets they are only touched on the
+// event goroutine.
+var tasks []*task
+
+var (
+	// writes are the changes to the server waiting for the one goroutine
+	// that makes them, so that they reach the server in the order they were
+	// made. The queue has no bound: adding to it never blocks the event
+	// goroutine, however far behind the server is.
+	writes      []func()
+	writesMu    sync.Mutex
+	writesReady = sync.NewCond(&writesMu)
+	// pendingWrites counts the writes queued or running. Loads wait for them
+	// so that they see the changes.
+	pendingWrites sync.WaitGroup
+	// writeCount counts the writes ever queued, so that a load can tell
+	// whether a change was made while it ran.
+	writeCount int
+)
+
+func init() {
+	go func() {
+		for {
+			writesMu.Lock()
+			for len(writes) == 0 {
+				writesReady.Wait()
+			}
+			write := writes[0]
+			writes[0] = nil
+			writes = writes[1:]
+			writesMu.Unlock()
+			write()
+		}
+	}()
+}
+
+// queueWrite puts a write at the back of the queue.
+func queueWrite(write func()) {
+	writesMu.Lock()
+	writes = append(writes, write)
+	writesMu.Unlock()
+	writesReady.Signal()
+}
+
+func startTask(label string) *task {
+	ctx, cancel := context.WithCancel(context.Background())
+	t := &task{label: label, ctx: ctx, cancel: cancel}
+	tasks = append(tasks, t)
+	if len(tasks) == 1 {
+		startSpinner()
+	}
+	drawStatus()
+	return t
+}
+
+// Cancel stops the task. Its result is dropped when it comes in.
+func (t *task) Cancel() {
+	t.cancel()
+	t.finish()
+}
+
+func (t *task) finish() {
+	t.cancel()
+	i := slices.Index(tasks, t)
+	if i < 0 {
+		return
+	}
+	tasks = slices.Delete(tasks, i, i+1)
+	if len(tasks) == 0 {
+		stopSpinner()
+	}
+	drawStatus()
+}
+
+// runTask runs work in the background and hands its result to done on the
+// event goroutine, unless the task has been cancelled by then.
+func runTask[T any](label string, work func(ctx context.Context) (T, error), done func(T, error)) *task {
+	t := startTask(label)
+	go func() {
+		var result T
+		err := recovered(func() (err error) {
+			result, err = work(t.ctx)
+			return err
+		})
+		ui.App.QueueUpdateDraw(func() {
+			if t.ctx.Err() != nil {
+				return
+			}
+			t.finish()
+			done(result, err)
+		})
+	}()
+	return t
+}
+
+// runWrite queues a change to the server behind the ones made before it and
+// hands its error to done, if not nil, on the event goroutine. Writes cannot
+// be cancelled: once made, a change is carried out.
+func runWrite(label string, work func() error, done func(err error)) {
+	t := startTask(label)
+	writeCount++
+	pendingWrites.Add(1)
+	queueWrite(func() {
+		err := recovered(work)
+		pendingWrites.Done()
+		ui.App.QueueUpdateDraw(func() {
+			t.finish()
+			if done != nil {
+				done(err)
+			}
+		})
+	})
+}
+
+// recovered runs work and turns a panic into an error, which unlike a panic
+// on the event goroutine would otherwise leave the terminal unusable.
+func recovered(work func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("panic in background task: %v\n%s", r, debug.Stack())
+			err = fmt.Errorf("internal error: %v", r)
+		}
+	}()
+	return work()
+}
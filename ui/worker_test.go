@@ -0,0 +1,49 @@
+package ui
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestQueueWriteKeepsOrderWithoutBlocking(t *testing.T) {
+	const count = 1000
+	release := make(chan struct{})
+	queued := make(chan struct{})
+	var order []int
+	finished := make(chan struct{})
+
+	go func() {
+		queueWrite(func() { <-release })
+		for i := 0; i < count; i++ {
+			queueWrite(func() {
+				order = append(order, i)
+				if i == count-1 {
+					close(finished)
+				}
+			})
+		}
+		close(queued)
+	}()
+
+	// the first write holds the writer, so every later one waits in the queue
+	select {
+	case <-queued:
+	case <-time.After(5 * time.Second):
+		t.Fatal("queueWrite blocked while the writer was busy")
+	}
+	close(release)
+
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("queued writes did not run")
+	}
+	want := make([]int, count)
+	for i := range want {
+		want[i] = i
+	}
+	if !slices.Equal(order, want) {
+		t.Errorf("writes ran out of order")
+	}
+}